@@ -1,15 +1,20 @@
 module github.com/jinglov/gomisc
 
-go 1.16
+go 1.17
 
 require (
-	github.com/Shopify/sarama v1.30.1
+	github.com/Shopify/sarama v1.37.2
 	github.com/aerospike/aerospike-client-go v4.5.2+incompatible
-	github.com/bsm/sarama-cluster v2.1.15+incompatible
+	github.com/eapache/go-xerial-snappy v0.0.0-20180814174437-776d5712da21
 	github.com/go-redis/redis v6.15.9+incompatible
-	github.com/prometheus/client_golang v1.11.0
+	github.com/klauspost/compress v1.15.11
+	github.com/linkedin/goavro/v2 v2.11.1
+	github.com/pierrec/lz4 v2.6.1+incompatible
+	github.com/prometheus/client_golang v1.13.0
 	github.com/samuel/go-zookeeper v0.0.0-20201211165307-7117e9ea2414 // indirect
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/wvanbergen/kafka v0.0.0-20171203153745-e2edea948ddf
 	github.com/wvanbergen/kazoo-go v0.0.0-20180202103751-f72d8611297a // indirect
+	github.com/xdg-go/scram v1.1.1
+	google.golang.org/protobuf v1.28.1
 )
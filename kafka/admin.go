@@ -0,0 +1,305 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/logger"
+)
+
+var (
+	ErrTopicExists        = errors.New("topic already exists")
+	ErrTopicNotFound      = errors.New("topic not found")
+	ErrGroupNotFound      = errors.New("consumer group not found")
+	ErrReplicationFactor  = errors.New("topic replication factor can not be changed")
+	ErrPartitionsDecrease = errors.New("topic partitions can not be decreased")
+	ErrGroupActive        = errors.New("consumer group has active members")
+)
+
+// AdminError is returned by all Admin calls, Err is one of the errors above
+// when it applies, Code is the kafka error code if the broker returned one
+type AdminError struct {
+	Op       string
+	Resource string
+	Code     sarama.KError
+	Err      error
+}
+
+func (e *AdminError) Error() string {
+	return fmt.Sprintf("kafka admin %s %s: %s", e.Op, e.Resource, e.Err.Error())
+}
+
+func (e *AdminError) Unwrap() error {
+	return e.Err
+}
+
+func adminError(op, resource string, err error) error {
+	if err == nil {
+		return nil
+	}
+	ae := &AdminError{Op: op, Resource: resource, Err: err}
+	var te *sarama.TopicError
+	var tpe *sarama.TopicPartitionError
+	var ke sarama.KError
+	switch {
+	case errors.As(err, &te):
+		ae.Code = te.Err
+	case errors.As(err, &tpe):
+		ae.Code = tpe.Err
+	case errors.As(err, &ke):
+		ae.Code = ke
+	}
+	switch ae.Code {
+	case sarama.ErrTopicAlreadyExists:
+		ae.Err = ErrTopicExists
+	case sarama.ErrUnknownTopicOrPartition:
+		ae.Err = ErrTopicNotFound
+	case sarama.ErrGroupIDNotFound:
+		ae.Err = ErrGroupNotFound
+	}
+	return ae
+}
+
+// TopicDescription is a topic with the config overridden on the topic
+type TopicDescription struct {
+	Name              string
+	Partitions        int32
+	ReplicationFactor int16
+	Config            map[string]string
+}
+
+// Admin manages topics and consumer groups
+type Admin struct {
+	client sarama.Client
+	admin  sarama.ClusterAdmin
+	log    logger.Logi
+}
+
+func NewAdmin(version string, brokers []string, opts ...optFun) (*Admin, error) {
+	options := &Options{
+		brokers: brokers,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+	if len(options.brokers) == 0 {
+		return nil, ErrBrokers
+	}
+	c := sarama.NewConfig()
+	if options.Name != "" {
+		c.ClientID = options.Name
+	}
+	c.Version = kafkaVersion(version)
+	if err := configureNet(c, options); err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewClient(options.brokers, c)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &Admin{client: client, admin: admin, log: options.log}, nil
+}
+
+func (a *Admin) Close() error {
+	return a.admin.Close()
+}
+
+func (a *Admin) CreateTopic(topic string, partitions int32, replicationFactor int16, config map[string]string) error {
+	detail := &sarama.TopicDetail{
+		NumPartitions:     partitions,
+		ReplicationFactor: replicationFactor,
+		ConfigEntries:     configEntries(config),
+	}
+	return adminError("create topic", topic, a.admin.CreateTopic(topic, detail, false))
+}
+
+func (a *Admin) DescribeTopic(topic string) (*TopicDescription, error) {
+	metadata, err := a.admin.DescribeTopics([]string{topic})
+	if err != nil {
+		return nil, adminError("describe topic", topic, err)
+	}
+	var tm *sarama.TopicMetadata
+	for _, m := range metadata {
+		if m.Name == topic {
+			tm = m
+		}
+	}
+	if tm == nil || len(tm.Partitions) == 0 {
+		return nil, adminError("describe topic", topic, sarama.ErrUnknownTopicOrPartition)
+	}
+	if tm.Err != sarama.ErrNoError {
+		return nil, adminError("describe topic", topic, tm.Err)
+	}
+	entries, err := a.admin.DescribeConfig(sarama.ConfigResource{Type: sarama.TopicResource, Name: topic})
+	if err != nil {
+		return nil, adminError("describe topic", topic, err)
+	}
+	d := &TopicDescription{
+		Name:              topic,
+		Partitions:        int32(len(tm.Partitions)),
+		ReplicationFactor: int16(len(tm.Partitions[0].Replicas)),
+		Config:            make(map[string]string),
+	}
+	for _, e := range entries {
+		// only the config set on the topic, brokers before 1.1 do not send the source
+		if e.Source == sarama.SourceTopic || (e.Source == sarama.SourceUnknown && !e.Default) {
+			d.Config[e.Name] = e.Value
+		}
+	}
+	return d, nil
+}
+
+// AlterTopicConfig replaces the config set on the topic, entries missing in
+// config are reset to the broker defaults
+func (a *Admin) AlterTopicConfig(topic string, config map[string]string) error {
+	return adminError("alter topic", topic, a.admin.AlterConfig(sarama.TopicResource, topic, configEntries(config), false))
+}
+
+func (a *Admin) DeleteTopic(topic string) error {
+	return adminError("delete topic", topic, a.admin.DeleteTopic(topic))
+}
+
+// AddPartitions increases the partitions of topic to count
+func (a *Admin) AddPartitions(topic string, count int32) error {
+	return adminError("add partitions", topic, a.admin.CreatePartitions(topic, count, nil, false))
+}
+
+// EnsureTopic creates the topic, or brings an existing one to at least
+// partitions and to config. It fails if the replication factor differs
+func (a *Admin) EnsureTopic(topic string, partitions int32, replicationFactor int16, config map[string]string) error {
+	d, err := a.DescribeTopic(topic)
+	if errors.Is(err, ErrTopicNotFound) {
+		err = a.CreateTopic(topic, partitions, replicationFactor, config)
+		if !errors.Is(err, ErrTopicExists) {
+			return err
+		}
+		// created concurrently by another instance
+		d, err = a.DescribeTopic(topic)
+	}
+	if err != nil {
+		return err
+	}
+	if d.ReplicationFactor != replicationFactor {
+		return adminError("ensure topic", topic, ErrReplicationFactor)
+	}
+	if d.Partitions < partitions {
+		if err = a.AddPartitions(topic, partitions); err != nil {
+			return err
+		}
+	}
+	changed := false
+	for k, v := range config {
+		if d.Config[k] != v {
+			d.Config[k] = v
+			changed = true
+		}
+	}
+	if changed {
+		return a.AlterTopicConfig(topic, d.Config)
+	}
+	return nil
+}
+
+// ListGroups returns the consumer groups and their protocol type
+func (a *Admin) ListGroups() (map[string]string, error) {
+	groups, err := a.admin.ListConsumerGroups()
+	return groups, adminError("list groups", "", err)
+}
+
+func (a *Admin) DescribeGroup(group string) (*sarama.GroupDescription, error) {
+	descriptions, err := a.admin.DescribeConsumerGroups([]string{group})
+	if err != nil {
+		return nil, adminError("describe group", group, err)
+	}
+	for _, d := range descriptions {
+		if d.GroupId != group {
+			continue
+		}
+		if d.Err != sarama.ErrNoError {
+			return nil, adminError("describe group", group, d.Err)
+		}
+		if d.State == "Dead" {
+			return nil, adminError("describe group", group, sarama.ErrGroupIDNotFound)
+		}
+		return d, nil
+	}
+	return nil, adminError("describe group", group, sarama.ErrGroupIDNotFound)
+}
+
+func (a *Admin) DeleteGroup(group string) error {
+	return adminError("delete group", group, a.admin.DeleteConsumerGroup(group))
+}
+
+// ResetGroupOffsets moves the offsets of group on topic to spec, on all
+// partitions when partitions is empty. The group must have no active members.
+// With dryRun the planned changes are logged and returned but not committed
+func (a *Admin) ResetGroupOffsets(group, topic string, partitions []int32, spec OffsetSpec, dryRun bool) ([]*OffsetChange, error) {
+	d, err := a.DescribeGroup(group)
+	switch {
+	case errors.Is(err, ErrGroupNotFound):
+	case err != nil:
+		return nil, err
+	case d.State != "Empty":
+		return nil, adminError("reset offsets", group, ErrGroupActive)
+	}
+	if len(partitions) == 0 {
+		if partitions, err = a.client.Partitions(topic); err != nil {
+			return nil, adminError("reset offsets", topic, err)
+		}
+	}
+	committed, err := fetchCommitted(a.client, group, map[string][]int32{topic: partitions})
+	if err != nil {
+		return nil, adminError("reset offsets", group, err)
+	}
+	changes := make([]*OffsetChange, 0, len(partitions))
+	offsets := make(map[topicPartition]int64, len(partitions))
+	for _, p := range partitions {
+		target, err := resolveOffset(a.client, topic, p, spec)
+		if err != nil {
+			return nil, adminError("reset offsets", topic, err)
+		}
+		tp := topicPartition{topic: topic, partition: p}
+		offsets[tp] = target
+		changes = append(changes, &OffsetChange{Group: group, Topic: topic, Partition: p, Current: committed[tp], Target: target})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Partition < changes[j].Partition })
+	if dryRun {
+		for _, c := range changes {
+			a.logf("dry run reset to %s, %s", spec, c)
+		}
+		return changes, nil
+	}
+	if err = commitOffsets(a.client, group, offsets); err != nil {
+		return nil, adminError("reset offsets", group, err)
+	}
+	for _, c := range changes {
+		a.logf("reset to %s, %s", spec, c)
+	}
+	return changes, nil
+}
+
+// logf logs the offset changes when a logger is set
+func (a *Admin) logf(format string, v ...interface{}) {
+	if a.log != nil {
+		a.log.Infof(format, v...)
+	}
+}
+
+func configEntries(config map[string]string) map[string]*string {
+	if len(config) == 0 {
+		return nil
+	}
+	entries := make(map[string]*string, len(config))
+	for k, v := range config {
+		v := v
+		entries[k] = &v
+	}
+	return entries
+}
@@ -0,0 +1,142 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func newMockAdmin(t *testing.T) (*Admin, *sarama.MockBroker) {
+	broker := sarama.NewMockBroker(t, 1)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetController(broker.BrokerID()).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()).
+			SetLeader("events", 0, broker.BrokerID()).
+			SetLeader("events", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("events", 0, sarama.OffsetOldest, 10).
+			SetOffset("events", 0, sarama.OffsetNewest, 100).
+			SetOffset("events", 0, eventsTime, 70).
+			SetOffset("events", 1, sarama.OffsetOldest, 0).
+			SetOffset("events", 1, sarama.OffsetNewest, 50).
+			SetOffset("events", 1, eventsTime, -1),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("idle-group", "events", 0, 90, "", sarama.ErrNoError).
+			SetOffset("idle-group", "events", 1, -1, "", sarama.ErrNoError).
+			SetOffset("test-group", "events", 0, 90, "", sarama.ErrNoError).
+			SetOffset("test-group", "events", 1, -1, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t).
+			SetError("test-group", "events", 1, sarama.ErrUnknownMemberId),
+		"CreateTopicsRequest":     sarama.NewMockCreateTopicsResponse(t),
+		"DeleteTopicsRequest":     sarama.NewMockDeleteTopicsResponse(t),
+		"CreatePartitionsRequest": sarama.NewMockCreatePartitionsResponse(t),
+		"DescribeConfigsRequest":  sarama.NewMockDescribeConfigsResponse(t),
+		"AlterConfigsRequest":     sarama.NewMockAlterConfigsResponse(t),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "test-group", broker).
+			SetCoordinator(sarama.CoordinatorGroup, "missing", broker).
+			SetCoordinator(sarama.CoordinatorGroup, "idle-group", broker),
+		"ListGroupsRequest": sarama.NewMockListGroupsResponse(t).AddGroup("test-group", "consumer"),
+		"DescribeGroupsRequest": sarama.NewMockDescribeGroupsResponse(t).
+			AddGroupDescription("test-group", &sarama.GroupDescription{GroupId: "test-group", State: "Stable", ProtocolType: "consumer"}).
+			AddGroupDescription("idle-group", &sarama.GroupDescription{GroupId: "idle-group", State: "Empty", ProtocolType: "consumer"}),
+		"DeleteGroupsRequest": sarama.NewMockDeleteGroupsRequest(t).SetDeletedGroups([]string{"test-group"}),
+	})
+	admin, err := NewAdmin("2.1.0.0", []string{broker.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admin, broker
+}
+
+func countRequests(broker *sarama.MockBroker, match func(interface{}) bool) int {
+	n := 0
+	for _, rr := range broker.History() {
+		if match(rr.Request) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAdminTopics(t *testing.T) {
+	admin, broker := newMockAdmin(t)
+	defer broker.Close()
+	defer admin.Close()
+
+	d, err := admin.DescribeTopic("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Partitions != 1 || d.ReplicationFactor != 1 || d.Config["retention.ms"] != "5000" {
+		t.Errorf("description %+v", d)
+	}
+	if _, ok := d.Config["max.message.bytes"]; ok {
+		t.Error("default config reported as topic config")
+	}
+
+	_, err = admin.DescribeTopic("missing")
+	var ae *AdminError
+	if !errors.Is(err, ErrTopicNotFound) || !errors.As(err, &ae) || ae.Code != sarama.ErrUnknownTopicOrPartition {
+		t.Errorf("missing topic err %v", err)
+	}
+
+	// create a missing topic
+	if err = admin.EnsureTopic("missing", 3, 1, map[string]string{"retention.ms": "1000"}); err != nil {
+		t.Fatal(err)
+	}
+	created := countRequests(broker, func(req interface{}) bool {
+		r, ok := req.(*sarama.CreateTopicsRequest)
+		return ok && r.TopicDetails["missing"] != nil && r.TopicDetails["missing"].NumPartitions == 3
+	})
+	if created != 1 {
+		t.Errorf("create topic requests %d", created)
+	}
+
+	// grow an existing topic, the config already matches
+	if err = admin.EnsureTopic("test", 4, 1, map[string]string{"retention.ms": "5000"}); err != nil {
+		t.Fatal(err)
+	}
+	grown := countRequests(broker, func(req interface{}) bool {
+		r, ok := req.(*sarama.CreatePartitionsRequest)
+		return ok && r.TopicPartitions["test"] != nil && r.TopicPartitions["test"].Count == 4
+	})
+	altered := countRequests(broker, func(req interface{}) bool {
+		_, ok := req.(*sarama.AlterConfigsRequest)
+		return ok
+	})
+	if grown != 1 || altered != 0 {
+		t.Errorf("create partitions requests %d, alter config requests %d", grown, altered)
+	}
+
+	if err = admin.EnsureTopic("test", 1, 3, nil); !errors.Is(err, ErrReplicationFactor) {
+		t.Errorf("replication factor err %v", err)
+	}
+	if err = admin.DeleteTopic("test"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAdminGroups(t *testing.T) {
+	admin, broker := newMockAdmin(t)
+	defer broker.Close()
+	defer admin.Close()
+
+	groups, err := admin.ListGroups()
+	if err != nil || groups["test-group"] != "consumer" {
+		t.Errorf("groups %v err %v", groups, err)
+	}
+	d, err := admin.DescribeGroup("test-group")
+	if err != nil || d.State != "Stable" {
+		t.Errorf("group %+v err %v", d, err)
+	}
+	if _, err = admin.DescribeGroup("missing"); !errors.Is(err, ErrGroupNotFound) {
+		t.Errorf("missing group err %v", err)
+	}
+	if err = admin.DeleteGroup("test-group"); err != nil {
+		t.Error(err)
+	}
+}
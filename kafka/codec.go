@@ -0,0 +1,107 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrCodecType = errors.New("codec does not support the value type")
+
+// Codec marshals the values sent and consumed as message values
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	// Decode decodes data into v, a pointer
+	Decode(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec encodes values implementing proto.Message
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Encode(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not a proto.Message", ErrCodecType, v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Decode(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T is not a proto.Message", ErrCodecType, v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// AvroCodec encodes values with an avro schema in the binary encoding.
+// Values are the goavro native types, structs are converted through their
+// json encoding which must match the avro json encoding of the schema
+type AvroCodec struct {
+	codec *goavro.Codec
+}
+
+func NewAvroCodec(schema string) (*AvroCodec, error) {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &AvroCodec{codec: codec}, nil
+}
+
+// Schema returns the canonical form of the schema
+func (c *AvroCodec) Schema() string {
+	return c.codec.CanonicalSchema()
+}
+
+func (c *AvroCodec) Encode(v interface{}) ([]byte, error) {
+	native := v
+	switch v.(type) {
+	case map[string]interface{}, []interface{}, string, bool, int, int32, int64, float32, float64, []byte, nil:
+	default:
+		text, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if native, _, err = c.codec.NativeFromTextual(text); err != nil {
+			return nil, err
+		}
+	}
+	return c.codec.BinaryFromNative(nil, native)
+}
+
+func (c *AvroCodec) Decode(data []byte, v interface{}) error {
+	native, _, err := c.codec.NativeFromBinary(data)
+	if err != nil {
+		return err
+	}
+	if p, ok := v.(*interface{}); ok {
+		*p = native
+		return nil
+	}
+	if p, ok := v.(*map[string]interface{}); ok {
+		if m, ok := native.(map[string]interface{}); ok {
+			*p = m
+			return nil
+		}
+	}
+	text, err := c.codec.TextualFromNative(nil, native)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(text, v)
+}
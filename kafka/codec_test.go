@@ -0,0 +1,113 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/monitor"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testEvent struct {
+	ID    string `json:"id"`
+	Count int64  `json:"count"`
+}
+
+const testEventSchema = `{"type":"record","name":"event","fields":[{"name":"id","type":"string"},{"name":"count","type":"long"}]}`
+
+func TestCodecs(t *testing.T) {
+	avro, err := NewAvroCodec(testEventSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, codec := range map[string]Codec{"json": JSONCodec{}, "avro": avro} {
+		data, err := codec.Encode(&testEvent{ID: "a", Count: 3})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var e testEvent
+		if err := codec.Decode(data, &e); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if e.ID != "a" || e.Count != 3 {
+			t.Errorf("%s: decoded %+v", name, e)
+		}
+	}
+
+	data, err := avro.Encode(map[string]interface{}{"id": "b", "count": int64(4)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var native interface{}
+	if err := avro.Decode(data, &native); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := native.(map[string]interface{}); !ok || m["id"] != "b" || m["count"] != int64(4) {
+		t.Errorf("avro native %v", native)
+	}
+	if _, err := avro.Encode(map[string]interface{}{"id": "c"}); err == nil {
+		t.Error("avro record without count encoded")
+	}
+
+	data, err = ProtobufCodec{}.Encode(wrapperspb.String("proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s wrapperspb.StringValue
+	if err := (ProtobufCodec{}).Decode(data, &s); err != nil || s.Value != "proto" {
+		t.Errorf("protobuf decoded %q %v", s.Value, err)
+	}
+	if _, err := (ProtobufCodec{}).Encode(&testEvent{}); !errors.Is(err, ErrCodecType) {
+		t.Errorf("protobuf encode of a struct %v", err)
+	}
+}
+
+func TestTypedProcess(t *testing.T) {
+	vec := monitor.NewKafkaVec("test", "kafka", "typed")
+	var got []*testEvent
+	process := func(msg *sarama.ConsumerMessage, v interface{}) error {
+		got = append(got, v.(*testEvent))
+		return nil
+	}
+	newValue := func() interface{} { return &testEvent{} }
+
+	fn := NewTypedProcess(JSONCodec{}, newValue, process, WithVec(vec))
+	if err := fn(&sarama.ConsumerMessage{Topic: "test", Value: []byte(`{"id":"a","count":1}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != "a" {
+		t.Errorf("processed %v", got)
+	}
+	err := fn(&sarama.ConsumerMessage{Topic: "test", Value: []byte("garbage")})
+	if !IsPermanent(err) {
+		t.Errorf("decode error %v is not permanent", err)
+	}
+	labels := map[string]string{"topic": "test", "partition": "0", "status": "decodeerror"}
+	if v, _ := metricValue(t, "test_kafka_typed", labels); v != 1 {
+		t.Errorf("decode errors %v", v)
+	}
+
+	var failed *sarama.ConsumerMessage
+	fn = NewTypedProcess(JSONCodec{}, newValue, process, WithDecodeErrorHandler(func(msg *sarama.ConsumerMessage, err error) error {
+		failed = msg
+		return nil
+	}))
+	if err := fn(&sarama.ConsumerMessage{Topic: "test", Value: []byte("garbage")}); err != nil || failed == nil {
+		t.Errorf("decode error handler not called: %v", err)
+	}
+	if len(got) != 1 {
+		t.Errorf("undecoded message processed")
+	}
+}
+
+func TestTypedProducerOverflow(t *testing.T) {
+	p := &Producer{queue: make(chan *sarama.ProducerMessage, 1), overflow: OverflowDropNewest}
+	tp := NewTypedProducer(p, JSONCodec{})
+	if err := tp.Send("test", &testEvent{ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.Send("test", &testEvent{ID: "b"}); err != ErrQueueFull {
+		t.Errorf("dropped message err %v", err)
+	}
+}
@@ -1,8 +1,12 @@
 package kafka
 
 import (
+	"errors"
 	"fmt"
+	"time"
+
 	"github.com/Shopify/sarama"
+	cluster "github.com/jinglov/gomisc/kafka/internal/cluster"
 	"github.com/jinglov/gomisc/logger"
 	"github.com/jinglov/gomisc/monitor"
 )
@@ -10,6 +14,12 @@ import (
 type Consumer interface {
 	Start() error
 	Close() error
+	// Pause stops handing out the messages of the partitions without leaving the group
+	Pause(topicPartitions map[string][]int32)
+	PauseAll()
+	Resume(topicPartitions map[string][]int32)
+	// ResumeAll resumes all partitions, including the ones paused with Pause
+	ResumeAll()
 }
 
 func NewConsumer(name string, topics []string, brokers []string, zookeepers []string, resetOffsets bool, fromOldest bool,
@@ -39,11 +49,88 @@ func NewConsumerV2(groupName string, version string, topics []string, brokers []
 	}
 	v := kafkaVersion(version)
 	if v.IsAtLeast(sarama.V2_0_0_0) {
-		return NewConsumer2(groupName, options.topics, options.brokers, options.fromOldest, process,
-			options.user, options.password, options.vec, v, options.log)
+		return newConsumer2(options, newMessageHandler(options, process), v)
+	} else if v.IsAtLeast(sarama.V1_0_0_0) {
+		return newConsumer11(options, newMessageHandler(options, process), v)
+	} else if len(options.zookeepers) > 0 {
+		return newConsumer08(options, process, v)
+	}
+	return nil, fmt.Errorf("invalid kafka version `%s`", version)
+}
+
+// NewBatchConsumer is like NewConsumerV2 but process receives the messages of
+// one partition in batches, see WithBatchSize and WithBatchLinger. When a batch
+// fails after its retries every message of it is dead-lettered with the error
+// of the batch
+func NewBatchConsumer(groupName string, version string, topics []string, brokers []string, process func([]*sarama.ConsumerMessage) error,
+	opts ...optFun) (Consumer, error) {
+	options := &Options{Name: groupName,
+		topics:  topics,
+		brokers: brokers,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+	FillBatchOption(options)
+	err := ValidConsumerOption(options)
+	if err != nil {
+		return nil, err
+	}
+	v := kafkaVersion(version)
+	if v.IsAtLeast(sarama.V2_0_0_0) {
+		return newConsumer2(options, newBatchHandler(options, process), v)
 	} else if v.IsAtLeast(sarama.V1_0_0_0) {
-		return NewConsumer11(groupName, options.topics, options.brokers, options.fromOldest, process,
-			options.user, options.password, options.vec, v, options.log)
+		return newConsumer11(options, newBatchHandler(options, process), v)
 	}
 	return nil, fmt.Errorf("invalid kafka version `%s`", version)
 }
+
+var (
+	ErrBalanceStrategy = errors.New("balance strategy not supported by this kafka version")
+	ErrRebalanceHooks  = errors.New("rebalance hooks require kafka version >= 2.0")
+	ErrGroupInstanceID = errors.New("static group membership requires kafka version >= 2.3")
+)
+
+// groupTuning holds the consumer group settings overriding the defaults,
+// unset fields keep them
+type groupTuning struct {
+	strategy          sarama.BalanceStrategy
+	sessionTimeout    time.Duration
+	heartbeatInterval time.Duration
+	maxProcessingTime time.Duration
+	instanceID        string
+}
+
+func (t *groupTuning) apply(c *sarama.Config) {
+	if t.strategy != nil {
+		c.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{t.strategy}
+	}
+	if t.sessionTimeout > 0 {
+		c.Consumer.Group.Session.Timeout = t.sessionTimeout
+	}
+	if t.heartbeatInterval > 0 {
+		c.Consumer.Group.Heartbeat.Interval = t.heartbeatInterval
+	}
+	if t.maxProcessingTime > 0 {
+		c.Consumer.MaxProcessingTime = t.maxProcessingTime
+	}
+	c.Consumer.Group.InstanceId = t.instanceID
+}
+
+// applyCluster applies the tuning to a sarama-cluster config, it balances
+// with range or round robin only
+func (t *groupTuning) applyCluster(c *cluster.Config) error {
+	t.apply(&c.Config)
+	if t.strategy == nil {
+		return nil
+	}
+	switch t.strategy.Name() {
+	case sarama.RangeBalanceStrategyName:
+		c.Group.PartitionStrategy = cluster.StrategyRange
+	case sarama.RoundRobinBalanceStrategyName:
+		c.Group.PartitionStrategy = cluster.StrategyRoundRobin
+	default:
+		return fmt.Errorf("%w: %s", ErrBalanceStrategy, t.strategy.Name())
+	}
+	return nil
+}
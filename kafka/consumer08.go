@@ -12,7 +12,8 @@ import (
 
 type Consumer08 struct {
 	cg         *consumergroup.ConsumerGroup
-	process    func(*sarama.ConsumerMessage) error
+	handler    *messageHandler
+	pauser     *pauser
 	monitorVec *monitor.KafkaVec
 	log        logger.Logi
 }
@@ -28,28 +29,51 @@ func NewConsumer08(
 	version sarama.KafkaVersion,
 	log logger.Logi,
 ) (*Consumer08, error) {
+	options := &Options{
+		Name:        name,
+		topics:      topics,
+		zookeepers:  zookeepers,
+		resetOffset: resetOffsets,
+		fromOldest:  fromOldest,
+		vec:         monitorVec,
+		log:         log,
+	}
+	return newConsumer08(options, process, version)
+}
+
+func newConsumer08(options *Options, process func(*sarama.ConsumerMessage) error, version sarama.KafkaVersion) (*Consumer08, error) {
+	if options.onAssigned != nil || options.onRevoked != nil {
+		return nil, ErrRebalanceHooks
+	}
+	if options.group.instanceID != "" {
+		return nil, ErrGroupInstanceID
+	}
 	config := consumergroup.NewConfig()
-	config.Offsets.ResetOffsets = resetOffsets
+	config.Offsets.ResetOffsets = options.resetOffset
 	config.Consumer.Group.Session.Timeout = 30 * time.Second
 	config.Admin.Timeout = 10 * time.Second
-	if !fromOldest {
+	if !options.fromOldest {
 		config.Offsets.Initial = sarama.OffsetNewest
 	}
 	config.Version = version
-	cg, err := consumergroup.JoinConsumerGroup(name, topics, zookeepers, config)
+	if err := configureNet(config.Config, options); err != nil {
+		return nil, err
+	}
+	cg, err := consumergroup.JoinConsumerGroup(options.Name, options.topics, options.zookeepers, config)
 	if err != nil {
 		return nil, err
 	}
 	return &Consumer08{
-		process:    process,
+		handler:    newMessageHandler(options, process),
+		pauser:     newPauser(options),
 		cg:         cg,
-		monitorVec: monitorVec,
-		log:        log,
+		monitorVec: options.vec,
+		log:        options.log,
 	}, nil
 }
 
 func (k *Consumer08) Start() error {
-	if k.process == nil {
+	if k.handler.process == nil {
 		return errors.New("process function is nil")
 	}
 	go k.doMessages()
@@ -58,19 +82,17 @@ func (k *Consumer08) Start() error {
 }
 
 func (k *Consumer08) Close() error {
+	k.handler.stop()
 	return k.cg.Close()
 }
 
 func (k *Consumer08) doMessages() {
 	for msg := range k.cg.Messages() {
-		if k.log != nil {
-			k.log.Debugf("receive partition: %d，offset: %d point: %p", msg.Partition, msg.Offset, msg)
-		}
-		if k.monitorVec != nil {
-			k.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "ok"})
+		if !k.pauser.wait(k.handler.exit, msg.Topic, msg.Partition) {
+			return
 		}
-		if err := k.process(msg); err != nil && k.log != nil {
-			k.log.Errorf("failed to process message from kafka: %s", err.Error())
+		if !k.handler.handle(nil, msg) {
+			return
 		}
 		if err := k.cg.CommitUpto(msg); err != nil && k.log != nil {
 			k.log.Errorf(err.Error())
@@ -90,3 +112,19 @@ func (k *Consumer08) doErrors() {
 		}
 	}
 }
+
+func (k *Consumer08) Pause(topicPartitions map[string][]int32) {
+	k.pauser.pause(topicPartitions)
+}
+
+func (k *Consumer08) PauseAll() {
+	k.pauser.pauseAll()
+}
+
+func (k *Consumer08) Resume(topicPartitions map[string][]int32) {
+	k.pauser.resume(topicPartitions)
+}
+
+func (k *Consumer08) ResumeAll() {
+	k.pauser.resumeAll()
+}
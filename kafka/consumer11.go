@@ -7,17 +7,20 @@ import (
 	"time"
 
 	"github.com/Shopify/sarama"
-	cluster "github.com/bsm/sarama-cluster"
+	cluster "github.com/jinglov/gomisc/kafka/internal/cluster"
 	"github.com/jinglov/gomisc/monitor"
 )
 
 type Consumer11 struct {
-	consumer   *cluster.Consumer
-	process    func(*sarama.ConsumerMessage) error
-	monitorVec *monitor.KafkaVec
-	exit       chan struct{}
-	wg         *sync.WaitGroup
-	log        logger.Logi
+	consumer    *cluster.Consumer
+	handler     *messageHandler
+	monitorVec  *monitor.KafkaVec
+	batchSize   int
+	batchLinger time.Duration
+	pauser      *pauser
+	exit        chan struct{}
+	wg          *sync.WaitGroup
+	log         logger.Logi
 }
 
 func NewConsumer11(
@@ -31,42 +34,78 @@ func NewConsumer11(
 	version sarama.KafkaVersion,
 	log logger.Logi,
 ) (*Consumer11, error) {
+	options := &Options{
+		Name:       groupId,
+		topics:     topics,
+		brokers:    brokers,
+		fromOldest: fromOldest,
+		user:       user,
+		password:   password,
+		vec:        monitorVec,
+		log:        log,
+	}
+	return newConsumer11(options, newMessageHandler(options, process), version)
+}
+
+func newConsumer11(options *Options, handler *messageHandler, version sarama.KafkaVersion) (*Consumer11, error) {
+	if options.onAssigned != nil || options.onRevoked != nil {
+		return nil, ErrRebalanceHooks
+	}
+	if options.group.instanceID != "" {
+		return nil, ErrGroupInstanceID
+	}
 	config := cluster.NewConfig()
 	config.Consumer.Return.Errors = true
 	config.Consumer.Offsets.CommitInterval = time.Second
 	config.Consumer.Group.Session.Timeout = 30 * time.Second
 	config.Admin.Timeout = 10 * time.Second
-	if fromOldest {
+	if options.fromOldest {
 		config.Consumer.Offsets.Initial = sarama.OffsetOldest
 	}
 	config.Version = version
-	if user != "" {
-		config.Net.SASL.Enable = true
-		config.Net.SASL.User = user
-		config.Net.SASL.Password = password
+	if options.readCommitted {
+		config.Consumer.IsolationLevel = sarama.ReadCommitted
+	}
+	if err := options.group.applyCluster(config); err != nil {
+		return nil, err
+	}
+	if err := configureNet(&config.Config, options); err != nil {
+		return nil, err
+	}
+	if !options.startTime.IsZero() {
+		if err := seedStartOffsets(options, &config.Config); err != nil {
+			return nil, err
+		}
 	}
 
-	consumer, err := cluster.NewConsumer(brokers, groupId, topics, config)
+	consumer, err := cluster.NewConsumer(options.brokers, options.Name, options.topics, config)
 	if err != nil {
 		return nil, err
 	}
 	return &Consumer11{
-		process:    process,
-		consumer:   consumer,
-		monitorVec: monitorVec,
-		log:        log,
+		handler:     handler,
+		consumer:    consumer,
+		monitorVec:  options.vec,
+		batchSize:   options.batchSize,
+		batchLinger: options.batchLinger,
+		pauser:      newPauser(options),
+		log:         options.log,
 	}, nil
 }
 
 func (k *Consumer11) Start() error {
-	if k.process == nil {
+	if k.handler.process == nil && k.handler.batchProcess == nil {
 		return errors.New("process function is nil")
 	}
 	k.exit = make(chan struct{})
 	k.wg = &sync.WaitGroup{}
 
 	k.wg.Add(1)
-	go k.doMessages()
+	if k.handler.batchProcess != nil {
+		go k.doBatches()
+	} else {
+		go k.doMessages()
+	}
 
 	k.wg.Add(1)
 	go k.doErrors()
@@ -78,6 +117,7 @@ func (k *Consumer11) Start() error {
 
 func (k *Consumer11) Close() error {
 	close(k.exit)
+	k.handler.stop()
 	k.wg.Wait()
 	err := k.consumer.CommitOffsets()
 	if err != nil && k.log != nil {
@@ -91,14 +131,11 @@ func (k *Consumer11) doMessages() {
 	for {
 		select {
 		case msg := <-k.consumer.Messages():
-			if k.log != nil {
-				k.log.Debugf("receive partition: %d，offset: %d point: %p", msg.Partition, msg.Offset, msg)
-			}
-			if k.monitorVec != nil {
-				k.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "ok"})
+			if !k.pauser.wait(k.exit, msg.Topic, msg.Partition) {
+				return
 			}
-			if err := k.process(msg); err != nil && k.log != nil {
-				k.log.Errorf("failed to process message from kafka: %s", err.Error())
+			if !k.handler.handle(nil, msg) {
+				return
 			}
 			k.consumer.MarkOffset(msg, "")
 		case <-k.exit:
@@ -107,6 +144,73 @@ func (k *Consumer11) doMessages() {
 	}
 }
 
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+type partitionBatch struct {
+	msgs  []*sarama.ConsumerMessage
+	first time.Time
+}
+
+// doBatches collects messages per partition and flushes a partition every
+// batchSize messages or once its oldest message waited for batchLinger
+func (k *Consumer11) doBatches() {
+	defer k.wg.Done()
+	batches := make(map[topicPartition]*partitionBatch)
+	flush := func(tp topicPartition, b *partitionBatch) bool {
+		if !k.handler.handleBatch(nil, b.msgs) {
+			return false
+		}
+		k.consumer.MarkOffset(b.msgs[len(b.msgs)-1], "")
+		delete(batches, tp)
+		return true
+	}
+	interval := k.batchLinger / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case msg := <-k.consumer.Messages():
+			if !k.pauser.wait(k.exit, msg.Topic, msg.Partition) {
+				for tp, b := range batches {
+					if !flush(tp, b) {
+						return
+					}
+				}
+				return
+			}
+			tp := topicPartition{topic: msg.Topic, partition: msg.Partition}
+			b, ok := batches[tp]
+			if !ok {
+				b = &partitionBatch{msgs: make([]*sarama.ConsumerMessage, 0, k.batchSize), first: time.Now()}
+				batches[tp] = b
+			}
+			b.msgs = append(b.msgs, msg)
+			if len(b.msgs) >= k.batchSize && !flush(tp, b) {
+				return
+			}
+		case now := <-tick.C:
+			for tp, b := range batches {
+				if now.Sub(b.first) >= k.batchLinger && !flush(tp, b) {
+					return
+				}
+			}
+		case <-k.exit:
+			for tp, b := range batches {
+				if !flush(tp, b) {
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
 func (k *Consumer11) doNotice() {
 	defer k.wg.Done()
 	for {
@@ -142,3 +246,21 @@ func (k *Consumer11) doErrors() {
 		}
 	}
 }
+
+// Pause holds back the messages of the partitions. All partitions share one
+// stream, so the next message of a paused partition also holds back the others
+func (k *Consumer11) Pause(topicPartitions map[string][]int32) {
+	k.pauser.pause(topicPartitions)
+}
+
+func (k *Consumer11) PauseAll() {
+	k.pauser.pauseAll()
+}
+
+func (k *Consumer11) Resume(topicPartitions map[string][]int32) {
+	k.pauser.resume(topicPartitions)
+}
+
+func (k *Consumer11) ResumeAll() {
+	k.pauser.resumeAll()
+}
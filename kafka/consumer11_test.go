@@ -0,0 +1,53 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/kafka/kafkatest"
+)
+
+func TestConsumer11(t *testing.T) {
+	cluster := kafkatest.NewCluster(t)
+	defer cluster.Close()
+	cluster.CreateTopic("test", 2)
+	cluster.Produce("test", 0, nil, []byte("a"))
+	cluster.Produce("test", 1, nil, []byte("b"))
+
+	received := make(chan string, 10)
+	process := func(msg *sarama.ConsumerMessage) error {
+		received <- string(msg.Value)
+		return nil
+	}
+	// the rebalance hooks are not run by sarama-cluster
+	if _, err := NewConsumerV2("test-consumer-11", "1.1.0.0", []string{"test"}, cluster.Addrs(), process,
+		WithOnRevoked(func(map[string][]int32) {})); err != ErrRebalanceHooks {
+		t.Errorf("hooks err %v", err)
+	}
+	if _, err := NewConsumerV2("test-consumer-11", "1.1.0.0", []string{"test"}, cluster.Addrs(), process,
+		WithGroupInstanceID("test-instance")); err != ErrGroupInstanceID {
+		t.Errorf("instance id err %v", err)
+	}
+
+	cp, err := NewConsumerV2("test-consumer-11", "1.1.0.0", []string{"test"}, cluster.Addrs(), process, WithFromOldest(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatal("messages not consumed")
+		}
+	}
+	if err = cp.Close(); err != nil {
+		t.Error(err)
+	}
+	if cluster.Committed("test-consumer-11", "test", 1) != 1 {
+		t.Errorf("offset not committed: %d", cluster.Committed("test-consumer-11", "test", 1))
+	}
+}
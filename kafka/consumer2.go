@@ -3,6 +3,8 @@ package kafka
 import (
 	"context"
 	"github.com/jinglov/gomisc/logger"
+	"hash/fnv"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -10,14 +12,23 @@ import (
 )
 
 type Consumer2 struct {
-	client     sarama.ConsumerGroup
-	process    func(*sarama.ConsumerMessage) error
-	monitorVec *monitor.KafkaVec
-	topics     []string
-	exit       chan struct{}
-	log        logger.Logi
+	client      sarama.ConsumerGroup
+	handler     *messageHandler
+	monitorVec  *monitor.KafkaVec
+	topics      []string
+	batchSize   int
+	batchLinger time.Duration
+	workers     int
+	pauser      *pauser
+	onAssigned  func(map[string][]int32)
+	onRevoked   func(map[string][]int32)
+	exit        chan struct{}
+	log         logger.Logi
 }
 
+// NewConsumer2 creates a consumer group client, process is called concurrently
+// for the claimed partitions, and for the keys of a partition with
+// WithClaimWorkers, so it must be goroutine-safe
 func NewConsumer2(
 	groupId string,
 	topics []string,
@@ -29,32 +40,70 @@ func NewConsumer2(
 	version sarama.KafkaVersion,
 	log logger.Logi,
 ) (*Consumer2, error) {
+	options := &Options{
+		Name:       groupId,
+		topics:     topics,
+		brokers:    brokers,
+		fromOldest: fromOldest,
+		user:       user,
+		password:   password,
+		vec:        monitorVec,
+		log:        log,
+	}
+	return newConsumer2(options, newMessageHandler(options, process), version)
+}
+
+func newConsumerConfig(options *Options, version sarama.KafkaVersion) (*sarama.Config, error) {
+	if options.group.instanceID != "" && !version.IsAtLeast(sarama.V2_3_0_0) {
+		return nil, ErrGroupInstanceID
+	}
 	config := sarama.NewConfig()
 	config.Consumer.Return.Errors = true
 	config.Consumer.Offsets.CommitInterval = time.Second
 	config.Consumer.Group.Session.Timeout = 30 * time.Second
 	config.Admin.Timeout = 10 * time.Second
-	if fromOldest {
+	if options.fromOldest {
 		config.Consumer.Offsets.Initial = sarama.OffsetOldest
 	}
 
 	config.Version = version
+	if options.readCommitted {
+		config.Consumer.IsolationLevel = sarama.ReadCommitted
+	}
 
-	if user != "" {
-		config.Net.SASL.Enable = true
-		config.Net.SASL.User = user
-		config.Net.SASL.Password = password
+	options.group.apply(config)
+	if err := configureNet(config, options); err != nil {
+		return nil, err
+	}
+	if !options.startTime.IsZero() {
+		if err := seedStartOffsets(options, config); err != nil {
+			return nil, err
+		}
 	}
-	client, err := sarama.NewConsumerGroup(brokers, groupId, config)
+	return config, nil
+}
+
+func newConsumer2(options *Options, handler *messageHandler, version sarama.KafkaVersion) (*Consumer2, error) {
+	config, err := newConsumerConfig(options, version)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewConsumerGroup(options.brokers, options.Name, config)
 	if err != nil {
 		return nil, err
 	}
 	consumer := &Consumer2{}
-	consumer.log = log
-	consumer.topics = topics
-	consumer.process = process
+	consumer.log = options.log
+	consumer.topics = options.topics
+	consumer.handler = handler
+	consumer.batchSize = options.batchSize
+	consumer.batchLinger = options.batchLinger
+	consumer.workers = options.claimWorkers
+	consumer.pauser = newPauser(options)
+	consumer.onAssigned = options.onAssigned
+	consumer.onRevoked = options.onRevoked
 	consumer.client = client
-	consumer.monitorVec = monitorVec
+	consumer.monitorVec = options.vec
 	return consumer, nil
 }
 
@@ -62,6 +111,9 @@ func (k *Consumer2) Setup(s sarama.ConsumerGroupSession) error {
 	if k.log != nil {
 		k.log.Infof("setup session member_id:%s ", s.MemberID())
 	}
+	if k.onAssigned != nil {
+		k.onAssigned(s.Claims())
+	}
 	return nil
 }
 
@@ -69,18 +121,25 @@ func (k *Consumer2) Cleanup(s sarama.ConsumerGroupSession) error {
 	if k.log != nil {
 		k.log.Infof("cleanup session member_id:%s ", s.MemberID())
 	}
+	// sarama commits the offsets after Cleanup returned
+	if k.onRevoked != nil {
+		k.onRevoked(s.Claims())
+	}
 	return nil
 }
 func (k *Consumer2) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if k.handler.batchProcess != nil {
+		return k.consumeBatch(session, claim)
+	}
+	if k.workers > 1 {
+		return k.consumeParallel(session, claim)
+	}
 	for msg := range claim.Messages() {
-		if k.log != nil {
-			k.log.Debugf("receive partition: %d，offset: %d point: %p", msg.Partition, msg.Offset, msg)
+		if !k.pauser.wait(session.Context().Done(), msg.Topic, msg.Partition) {
+			return nil
 		}
-		if k.monitorVec != nil {
-			k.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "ok"})
-		}
-		if err := k.process(msg); err != nil && k.log != nil {
-			k.log.Errorf("failed to process message from kafka: %s", err.Error())
+		if !k.handler.handle(session.Context().Done(), msg) {
+			return nil
 		}
 		session.MarkMessage(msg, "")
 
@@ -88,6 +147,50 @@ func (k *Consumer2) ConsumeClaim(session sarama.ConsumerGroupSession, claim sara
 	return nil
 }
 
+// consumeBatch flushes the claim messages every batchSize messages or once the
+// oldest one waited for batchLinger, offsets are marked after the batch is done
+func (k *Consumer2) consumeBatch(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	batch := make([]*sarama.ConsumerMessage, 0, k.batchSize)
+	linger := time.NewTimer(k.batchLinger)
+	stopTimer(linger)
+	defer linger.Stop()
+	flush := func() bool {
+		stopTimer(linger)
+		if len(batch) == 0 {
+			return true
+		}
+		if !k.handler.handleBatch(session.Context().Done(), batch) {
+			return false
+		}
+		session.MarkMessage(batch[len(batch)-1], "")
+		batch = make([]*sarama.ConsumerMessage, 0, k.batchSize)
+		return true
+	}
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				flush()
+				return nil
+			}
+			if !k.pauser.wait(session.Context().Done(), msg.Topic, msg.Partition) {
+				return nil
+			}
+			if len(batch) == 0 {
+				linger.Reset(k.batchLinger)
+			}
+			batch = append(batch, msg)
+			if len(batch) >= k.batchSize && !flush() {
+				return nil
+			}
+		case <-linger.C:
+			if !flush() {
+				return nil
+			}
+		}
+	}
+}
+
 func (k *Consumer2) Start() error {
 	ctx := context.Background()
 	k.exit = make(chan struct{})
@@ -110,6 +213,7 @@ func (k *Consumer2) Start() error {
 
 func (k *Consumer2) Close() error {
 	close(k.exit)
+	k.handler.stop()
 	if k.client == nil {
 		return nil
 	}
@@ -128,3 +232,84 @@ func (k *Consumer2) doErrors() {
 		}
 	}
 }
+
+// consumeParallel dispatches the claim messages to workers by key hash so
+// messages of one key keep their order, the offset is marked up to the lowest
+// message not done yet
+func (k *Consumer2) consumeParallel(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tracker := newOffsetTracker()
+	done := session.Context().Done()
+	queues := make([]chan *sarama.ConsumerMessage, k.workers)
+	wg := &sync.WaitGroup{}
+	for i := range queues {
+		queues[i] = make(chan *sarama.ConsumerMessage, claimWorkerQueueSize)
+		wg.Add(1)
+		go func(queue chan *sarama.ConsumerMessage) {
+			defer wg.Done()
+			for msg := range queue {
+				select {
+				case <-done:
+					continue
+				default:
+				}
+				if !k.handler.handle(done, msg) {
+					continue
+				}
+				tracker.complete(msg.Offset, func(next int64) {
+					session.MarkOffset(msg.Topic, msg.Partition, next, "")
+				})
+			}
+		}(queues[i])
+	}
+	for msg := range claim.Messages() {
+		if !k.pauser.wait(done, msg.Topic, msg.Partition) {
+			break
+		}
+		tracker.add(msg.Offset)
+		queues[workerIndex(msg, k.workers)] <- msg
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return nil
+}
+
+const claimWorkerQueueSize = 64
+
+// workerIndex hashes the message key onto n workers, messages without key
+// are spread by offset
+func workerIndex(msg *sarama.ConsumerMessage, n int) int {
+	if msg.Key == nil {
+		return int(msg.Offset % int64(n))
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(msg.Key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// stopTimer stops t and drains its channel so it can be Reset safely
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+func (k *Consumer2) Pause(topicPartitions map[string][]int32) {
+	k.pauser.pause(topicPartitions)
+}
+
+func (k *Consumer2) PauseAll() {
+	k.pauser.pauseAll()
+}
+
+func (k *Consumer2) Resume(topicPartitions map[string][]int32) {
+	k.pauser.resume(topicPartitions)
+}
+
+func (k *Consumer2) ResumeAll() {
+	k.pauser.resumeAll()
+}
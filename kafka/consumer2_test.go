@@ -0,0 +1,166 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type testSession struct {
+	ctx    context.Context
+	claims map[string][]int32
+	mu     sync.Mutex
+	marked map[string]map[int32]int64
+}
+
+func newTestSession(claims map[string][]int32) *testSession {
+	return &testSession{ctx: context.Background(), claims: claims, marked: make(map[string]map[int32]int64)}
+}
+
+func (s *testSession) Claims() map[string][]int32 { return s.claims }
+func (s *testSession) MemberID() string           { return "test-member" }
+func (s *testSession) GenerationID() int32        { return 1 }
+func (s *testSession) Commit()                    {}
+func (s *testSession) Context() context.Context   { return s.ctx }
+
+func (s *testSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.marked[topic] == nil {
+		s.marked[topic] = make(map[int32]int64)
+	}
+	if offset > s.marked[topic][partition] {
+		s.marked[topic][partition] = offset
+	}
+}
+
+func (s *testSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.marked[topic] == nil {
+		s.marked[topic] = make(map[int32]int64)
+	}
+	s.marked[topic][partition] = offset
+}
+
+func (s *testSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *testSession) offset(topic string, partition int32) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.marked[topic][partition]
+}
+
+type testClaim struct {
+	topic     string
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func newTestClaim(topic string, partition int32, n int) *testClaim {
+	c := &testClaim{topic: topic, partition: partition, messages: make(chan *sarama.ConsumerMessage, n)}
+	for i := 0; i < n; i++ {
+		c.messages <- &sarama.ConsumerMessage{Topic: topic, Partition: partition, Offset: int64(i), Value: []byte("test_data")}
+	}
+	return c
+}
+
+func (c *testClaim) Topic() string                            { return c.topic }
+func (c *testClaim) Partition() int32                         { return c.partition }
+func (c *testClaim) InitialOffset() int64                     { return 0 }
+func (c *testClaim) HighWaterMarkOffset() int64               { return int64(len(c.messages)) }
+func (c *testClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func TestConsumer2Batch(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int
+	options := &Options{batchSize: 4, batchLinger: 20 * time.Millisecond}
+	k := &Consumer2{
+		handler: newBatchHandler(options, func(msgs []*sarama.ConsumerMessage) error {
+			mu.Lock()
+			sizes = append(sizes, len(msgs))
+			mu.Unlock()
+			return nil
+		}),
+		batchSize:   options.batchSize,
+		batchLinger: options.batchLinger,
+	}
+	session := newTestSession(nil)
+	claim := newTestClaim("test", 0, 10)
+	close(claim.messages)
+	if err := k.ConsumeClaim(session, claim); err != nil {
+		t.Fatal(err)
+	}
+	if session.offset("test", 0) != 10 {
+		t.Errorf("marked offset %d", session.offset("test", 0))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sizes) != 3 || sizes[0] != 4 || sizes[1] != 4 || sizes[2] != 2 {
+		t.Errorf("batch sizes %v", sizes)
+	}
+}
+
+func TestConsumer2Parallel(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[string][]int64)
+	options := &Options{}
+	k := &Consumer2{
+		handler: newMessageHandler(options, func(msg *sarama.ConsumerMessage) error {
+			time.Sleep(time.Duration(msg.Offset%3) * time.Millisecond)
+			mu.Lock()
+			seen[string(msg.Key)] = append(seen[string(msg.Key)], msg.Offset)
+			mu.Unlock()
+			return nil
+		}),
+		workers: 4,
+	}
+	session := newTestSession(nil)
+	claim := newTestClaim("test", 0, 100)
+	for i := 0; i < 100; i++ {
+		msg := <-claim.messages
+		msg.Key = []byte{byte('a' + i%7)}
+		claim.messages <- msg
+	}
+	close(claim.messages)
+	if err := k.ConsumeClaim(session, claim); err != nil {
+		t.Fatal(err)
+	}
+	if session.offset("test", 0) != 100 {
+		t.Errorf("marked offset %d", session.offset("test", 0))
+	}
+	for key, offsets := range seen {
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Errorf("key %s processed out of order: %v", key, offsets)
+				break
+			}
+		}
+	}
+}
+
+func TestConsumer2Hooks(t *testing.T) {
+	var assigned, revoked map[string][]int32
+	k := &Consumer2{
+		onAssigned: func(tps map[string][]int32) { assigned = tps },
+		onRevoked:  func(tps map[string][]int32) { revoked = tps },
+	}
+	session := newTestSession(map[string][]int32{"test": {0, 1}})
+	if err := k.Setup(session); err != nil {
+		t.Fatal(err)
+	}
+	if len(assigned["test"]) != 2 || revoked != nil {
+		t.Errorf("assigned %v revoked %v", assigned, revoked)
+	}
+	if err := k.Cleanup(session); err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked["test"]) != 2 {
+		t.Errorf("revoked %v", revoked)
+	}
+}
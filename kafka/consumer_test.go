@@ -1,28 +1,199 @@
 package kafka
 
 import (
-	"fmt"
-	"github.com/Shopify/sarama"
+	"errors"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/kafka/kafkatest"
 )
 
 func TestConsumerV2(t *testing.T) {
-	cp, err := NewConsumerV2("test-consumer-v2", "2.1.0.0", topics, brokers, testMessage)
+	cluster := kafkatest.NewCluster(t)
+	defer cluster.Close()
+	cluster.CreateTopic("test", 2)
+	cluster.Produce("test", 0, nil, []byte("a"))
+	cluster.Produce("test", 1, nil, []byte("b"))
+	cluster.Produce("test", 1, nil, []byte("fail"))
+
+	var mu sync.Mutex
+	var assigned []map[string][]int32
+	received := make(chan string, 10)
+	dlq, err := NewProducerV2("test-dlq", "2.1.0.0", cluster.Addrs())
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	err = cp.Start()
+	dlq.Start()
+	defer dlq.Close()
+
+	cp, err := NewConsumerV2("test-consumer-v2", "2.1.0.0", []string{"test"}, cluster.Addrs(),
+		func(msg *sarama.ConsumerMessage) error {
+			received <- string(msg.Value)
+			if string(msg.Value) == "fail" {
+				return errors.New("process failed")
+			}
+			return nil
+		},
+		WithFromOldest(true),
+		WithDeadLetter("test-dlq", dlq),
+		WithOnAssigned(func(tps map[string][]int32) {
+			mu.Lock()
+			defer mu.Unlock()
+			assigned = append(assigned, tps)
+		}))
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if err = cp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatal("messages not consumed")
+		}
+	}
+	if msgs := cluster.WaitMessages("test-dlq", 1, 10*time.Second); len(msgs) != 1 || string(msgs[0].Value) != "fail" {
+		t.Errorf("dead letters %v", msgs)
+	}
+	if !cluster.WaitCommitted("test-consumer-v2", "test", 1, 2, 10*time.Second) {
+		t.Errorf("offset not committed: %d", cluster.Committed("test-consumer-v2", "test", 1))
+	}
+
+	// after the rebalance the consumer only owns partition 0
+	generation := cluster.Generation("test-consumer-v2")
+	cluster.Rebalance("test-consumer-v2", map[string][]int32{"test": {0}})
+	if !cluster.WaitGeneration("test-consumer-v2", generation+1, 10*time.Second) {
+		t.Fatal("consumer did not rejoin")
+	}
+	cluster.Produce("test", 0, nil, []byte("c"))
+	select {
+	case v := <-received:
+		if v != "c" {
+			t.Errorf("received %s", v)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not consumed after rebalance")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(assigned) != 2 || len(assigned[1]["test"]) != 1 || assigned[1]["test"][0] != 0 {
+		t.Errorf("assignments %v", assigned)
+	}
+}
+
+func TestGroupTuning(t *testing.T) {
+	options := &Options{}
+	for _, o := range []optFun{
+		WithBalanceStrategy(sarama.BalanceStrategySticky),
+		WithSessionTimeout(10 * time.Second),
+		WithHeartbeatInterval(time.Second),
+		WithMaxProcessingTime(time.Second),
+	} {
+		o(options)
+	}
+	c, err := newConsumerConfig(options, sarama.V2_1_0_0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Consumer.Group.Rebalance.GroupStrategies[0].Name() != sarama.StickyBalanceStrategyName {
+		t.Errorf("strategy %s", c.Consumer.Group.Rebalance.GroupStrategies[0].Name())
+	}
+	if c.Consumer.Group.Session.Timeout != 10*time.Second || c.Consumer.Group.Heartbeat.Interval != time.Second ||
+		c.Consumer.MaxProcessingTime != time.Second {
+		t.Errorf("session %s heartbeat %s processing %s", c.Consumer.Group.Session.Timeout,
+			c.Consumer.Group.Heartbeat.Interval, c.Consumer.MaxProcessingTime)
+	}
+
+	// unset options keep the defaults
+	if c, _ = newConsumerConfig(&Options{}, sarama.V2_1_0_0); c.Consumer.Group.Session.Timeout != 30*time.Second ||
+		c.Consumer.Group.Rebalance.GroupStrategies[0].Name() != sarama.RangeBalanceStrategyName {
+		t.Errorf("defaults changed: %s %s", c.Consumer.Group.Session.Timeout, c.Consumer.Group.Rebalance.GroupStrategies[0].Name())
+	}
+
+	// sarama-cluster has no sticky strategy
+	_, err = NewConsumerV2("test-sticky", "1.1.0.0", []string{"test"}, []string{"127.0.0.1:9"},
+		func(*sarama.ConsumerMessage) error { return nil }, WithBalanceStrategy(sarama.BalanceStrategySticky))
+	if !errors.Is(err, ErrBalanceStrategy) {
+		t.Errorf("sticky strategy before 2.0: %v", err)
+	}
+
+	cluster := kafkatest.NewCluster(t)
+	defer cluster.Close()
+	cluster.Produce("test", 0, nil, []byte("a"))
+	received := make(chan struct{}, 1)
+	cp, err := NewConsumerV2("test-sticky", "2.1.0.0", []string{"test"}, cluster.Addrs(),
+		func(*sarama.ConsumerMessage) error {
+			received <- struct{}{}
+			return nil
+		},
+		WithFromOldest(true),
+		WithBalanceStrategy(sarama.BalanceStrategySticky),
+		WithSessionTimeout(10*time.Second),
+		WithHeartbeatInterval(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sticky consumer did not consume")
 	}
-	time.Sleep(10 * time.Second)
-	cp.Close()
 }
 
-func testMessage(msg *sarama.ConsumerMessage) error {
-	fmt.Println(string(msg.Value))
-	return nil
+func TestConsumerStaticMember(t *testing.T) {
+	cluster := kafkatest.NewCluster(t)
+	defer cluster.Close()
+	cluster.Produce("test", 0, nil, []byte("a"))
+	process := func(*sarama.ConsumerMessage) error { return nil }
+	if _, err := NewConsumerV2("test-static", "2.1.0.0", []string{"test"}, cluster.Addrs(), process,
+		WithGroupInstanceID("test-instance")); err != ErrGroupInstanceID {
+		t.Errorf("instance id before 2.3: %v", err)
+	}
+
+	start := func() Consumer {
+		cp, err := NewConsumerV2("test-static", "2.3.0.0", []string{"test"}, cluster.Addrs(), process,
+			WithFromOldest(true),
+			WithGroupInstanceID("test-instance"),
+			WithSessionTimeout(10*time.Second),
+			WithHeartbeatInterval(100*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cp.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return cp
+	}
+	cp := start()
+	if !cluster.WaitGeneration("test-static", 1, 10*time.Second) {
+		t.Fatal("consumer did not join")
+	}
+	// a static member does not leave on close and rejoins in its generation
+	cp.Close()
+	if members := cluster.Members("test-static"); len(members) != 1 {
+		t.Fatalf("members after close %v", members)
+	}
+	previous := cluster.Members("test-static")[0]
+	cp = start()
+	defer cp.Close()
+	cluster.Produce("test", 0, nil, []byte("b"))
+	if !cluster.WaitCommitted("test-static", "test", 0, 2, 10*time.Second) {
+		t.Fatal("restarted consumer did not consume")
+	}
+	if members := cluster.Members("test-static"); len(members) != 1 || members[0] == previous {
+		t.Errorf("members after restart %v, previous %s", members, previous)
+	}
+	if generation := cluster.Generation("test-static"); generation != 1 {
+		t.Errorf("generation %d after restart", generation)
+	}
 }
@@ -0,0 +1,208 @@
+package kafka
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/logger"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+const (
+	primaryCluster int32 = iota
+	secondaryCluster
+)
+
+var clusterNames = []string{"primary", "secondary"}
+
+type failoverOptions struct {
+	threshold int
+	interval  time.Duration
+}
+
+// failover switches the producer workers between the primary and the
+// secondary cluster. It fails over after consecutive send errors or failed
+// metadata refreshes of the primary and fails back once the primary answers
+// the health checks again
+type failover struct {
+	primary   []string
+	config    *sarama.Config
+	threshold int
+	interval  time.Duration
+	vec       *monitor.KafkaClusterVec
+	log       logger.Logi
+
+	active      int32
+	mu          sync.Mutex
+	sendErrors  int
+	checkErrors int
+	healthy     int
+	// switched is closed and replaced when the active cluster changes
+	switched chan struct{}
+
+	exit chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newFailover(options *Options, version sarama.KafkaVersion) (*failover, error) {
+	f := &failover{
+		primary:   options.brokers,
+		threshold: options.failover.threshold,
+		interval:  options.failover.interval,
+		vec:       options.clusterVec,
+		log:       options.log,
+		switched:  make(chan struct{}),
+		exit:      make(chan struct{}),
+	}
+	if f.threshold <= 0 {
+		f.threshold = 5
+	}
+	if f.interval <= 0 {
+		f.interval = 10 * time.Second
+	}
+	c := sarama.NewConfig()
+	c.ClientID = options.Name
+	c.Version = version
+	if err := configureNet(c, options); err != nil {
+		return nil, err
+	}
+	// a health check is a single metadata request bounded by the interval
+	c.Metadata.Retry.Max = 0
+	c.Net.DialTimeout = f.interval
+	c.Net.ReadTimeout = f.interval
+	c.Net.WriteTimeout = f.interval
+	f.config = c
+	if f.vec != nil {
+		f.vec.SetActive(clusterNames[primaryCluster], true)
+		f.vec.SetActive(clusterNames[secondaryCluster], false)
+	}
+	return f, nil
+}
+
+func (f *failover) start() {
+	f.wg.Add(1)
+	go f.loop()
+}
+
+func (f *failover) stop() {
+	close(f.exit)
+	f.wg.Wait()
+}
+
+func (f *failover) cluster() int32 {
+	return atomic.LoadInt32(&f.active)
+}
+
+// changed returns a channel closed once the active cluster changes
+func (f *failover) changed() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.switched
+}
+
+func (f *failover) loop() {
+	defer f.wg.Done()
+	tick := time.NewTicker(f.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			f.checked(f.check())
+		case <-f.exit:
+			return
+		}
+	}
+}
+
+// check refreshes the metadata of the primary cluster with a new client, the
+// client of a producer keeps retrying the brokers it knows
+func (f *failover) check() error {
+	client, err := sarama.NewClient(f.primary, f.config)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func (f *failover) checked(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		if f.log != nil {
+			f.log.Warnf("primary kafka cluster health check failed: %s", err.Error())
+		}
+		f.healthy = 0
+		f.checkErrors++
+		if f.checkErrors >= f.threshold && f.cluster() == primaryCluster {
+			f.switchTo(secondaryCluster)
+		}
+		return
+	}
+	f.checkErrors = 0
+	f.healthy++
+	if f.healthy >= f.threshold && f.cluster() == secondaryCluster {
+		f.switchTo(primaryCluster)
+	}
+}
+
+func (f *failover) success(cluster int32, topic string) {
+	f.inc(cluster, topic, "ok")
+	if cluster != primaryCluster {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sendErrors = 0
+}
+
+func (f *failover) failure(cluster int32, topic string) {
+	f.inc(cluster, topic, "error")
+	if cluster != primaryCluster {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sendErrors++
+	if f.sendErrors >= f.threshold && f.cluster() == primaryCluster {
+		f.switchTo(secondaryCluster)
+	}
+}
+
+// switchTo makes cluster the active one, f.mu is held
+func (f *failover) switchTo(cluster int32) {
+	atomic.StoreInt32(&f.active, cluster)
+	close(f.switched)
+	f.switched = make(chan struct{})
+	f.sendErrors = 0
+	f.checkErrors = 0
+	f.healthy = 0
+	status := "failover"
+	if cluster == primaryCluster {
+		status = "failback"
+	}
+	if f.log != nil {
+		f.log.Warnf("kafka producer %s to the %s cluster", status, clusterNames[cluster])
+	}
+	f.inc(cluster, "", status)
+	if f.vec != nil {
+		f.vec.SetActive(clusterNames[cluster], true)
+		f.vec.SetActive(clusterNames[1-cluster], false)
+	}
+}
+
+func (f *failover) inc(cluster int32, topic, status string) {
+	if f.vec != nil {
+		f.vec.Inc(&monitor.KafkaClusterLabels{Cluster: clusterNames[cluster], Topic: topic, Status: status})
+	}
+}
+
+// ActiveCluster returns the cluster the producer sends to, primary or
+// secondary, it is always primary without WithSecondaryBrokers
+func (p *Producer) ActiveCluster() string {
+	if p.failover == nil {
+		return clusterNames[primaryCluster]
+	}
+	return clusterNames[p.failover.cluster()]
+}
@@ -0,0 +1,133 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/kafka/kafkatest"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+func waitCluster(t *testing.T, p *Producer, cluster string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for p.ActiveCluster() != cluster {
+		if time.Now().After(deadline) {
+			t.Fatalf("active cluster is %s, want %s", p.ActiveCluster(), cluster)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProducerFailover(t *testing.T) {
+	primary := kafkatest.NewCluster(t)
+	defer primary.Close()
+	secondary := kafkatest.NewCluster(t)
+	defer secondary.Close()
+
+	p, err := NewProducerV2("test-failover", "2.1.0.0", primary.Addrs(),
+		WithSecondaryBrokers(secondary.Addrs()),
+		WithFailover(2, 20*time.Millisecond),
+		WithProducerRetry(3, 10*time.Millisecond),
+		WithClusterVec(monitor.NewKafkaClusterVec("test", "kafka", "failover")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Close()
+	if p.ActiveCluster() != "primary" {
+		t.Fatalf("active cluster %s", p.ActiveCluster())
+	}
+	// the message is acknowledged before the primary goes down, else it is
+	// sent again after failback
+	if _, _, err = p.SendSync(context.Background(), &sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := primary.WaitMessages("test", 1, 10*time.Second); len(msgs) != 1 {
+		t.Fatalf("primary messages %v", msgs)
+	}
+
+	// failed health checks of the primary fail over
+	primary.SetDown(true)
+	waitCluster(t, p, "secondary")
+	p.Send("test", []byte("b"))
+	if msgs := secondary.WaitMessages("test", 1, 10*time.Second); len(msgs) != 1 || string(msgs[0].Value) != "b" {
+		t.Fatalf("secondary messages %v", msgs)
+	}
+
+	primary.SetDown(false)
+	waitCluster(t, p, "primary")
+	p.Send("test", []byte("c"))
+	if msgs := primary.WaitMessages("test", 2, 10*time.Second); len(msgs) != 2 || string(msgs[1].Value) != "c" {
+		t.Fatalf("primary messages after failback %v", msgs)
+	}
+}
+
+func TestProducerFailoverSendErrors(t *testing.T) {
+	primary := kafkatest.NewCluster(t)
+	defer primary.Close()
+	secondary := kafkatest.NewCluster(t)
+	defer secondary.Close()
+	primary.CreateTopic("test", 1)
+	primary.SetProduceError("test", 0, sarama.ErrBrokerNotAvailable)
+
+	p, err := NewProducerV2("test-failover-errors", "2.1.0.0", primary.Addrs(),
+		WithSecondaryBrokers(secondary.Addrs()),
+		WithFailover(2, time.Hour),
+		WithQueueSize(10),
+		WithProducerRetry(0, time.Millisecond),
+		WithCachePath(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	defer p.Close()
+	p.Send("test", []byte("a"))
+	p.Send("test", []byte("b"))
+	waitCluster(t, p, "secondary")
+
+	// the messages spilled by the primary are replayed to the secondary
+	p.localCache.ProcessAll()
+	if msgs := secondary.WaitMessages("test", 2, 10*time.Second); len(msgs) != 2 {
+		t.Fatalf("secondary messages %v", msgs)
+	}
+	if msgs := primary.Messages("test"); len(msgs) != 0 {
+		t.Errorf("primary messages %v", msgs)
+	}
+}
+
+func TestProducerFailoverStalled(t *testing.T) {
+	stalled := &stuckProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+		release:   make(chan struct{}),
+	}
+	secondary := newRecordProducer(0)
+	f, err := newFailover(&Options{Name: "test-failover-stalled", failover: failoverOptions{threshold: 1, interval: time.Hour}}, sarama.V2_1_0_0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Producer{numWorkers: 1, queue: make(chan *sarama.ProducerMessage, 10), failover: f}
+	p.works = []*producerWorker{{producer: stalled, secondary: secondary, failover: f, queue: p.queue}}
+	p.Start()
+	defer func() {
+		close(stalled.release)
+		p.Close()
+	}()
+
+	// the worker is blocked on the input of the stalled primary when it fails over
+	p.Send("test", []byte("a"))
+	time.Sleep(20 * time.Millisecond)
+	f.mu.Lock()
+	f.switchTo(secondaryCluster)
+	f.mu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(secondary.messages()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not moved to the secondary")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,286 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/logger"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+// headers set on messages republished to the dead-letter topic
+const (
+	DLQHeaderTopic     = "x-dlq-topic"
+	DLQHeaderPartition = "x-dlq-partition"
+	DLQHeaderOffset    = "x-dlq-offset"
+	DLQHeaderError     = "x-dlq-error"
+	DLQHeaderAttempts  = "x-dlq-attempts"
+)
+
+// strictRetryPolicy is the backoff used in strict mode when no retry policy is set
+var strictRetryPolicy = RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}
+
+// messageHandler runs the process callback for every consumer generation
+type messageHandler struct {
+	process      func(*sarama.ConsumerMessage) error
+	batchProcess func([]*sarama.ConsumerMessage) error
+	monitorVec   *monitor.KafkaVec
+	batchVec     *monitor.KafkaBatchVec
+	dlqTopic     string
+	dlqProducer  *Producer
+	retry        *RetryPolicy
+	strict       bool
+	exit         chan struct{}
+	exitOnce     sync.Once
+	log          logger.Logi
+}
+
+func newMessageHandler(options *Options, process func(*sarama.ConsumerMessage) error) *messageHandler {
+	return &messageHandler{
+		process:     process,
+		monitorVec:  options.vec,
+		dlqTopic:    options.dlqTopic,
+		dlqProducer: options.dlqProducer,
+		retry:       options.retry,
+		strict:      options.strict,
+		exit:        make(chan struct{}),
+		log:         options.log,
+	}
+}
+
+func newBatchHandler(options *Options, process func([]*sarama.ConsumerMessage) error) *messageHandler {
+	h := newMessageHandler(options, nil)
+	h.batchProcess = process
+	h.batchVec = options.batchVec
+	return h
+}
+
+// stop interrupts any pending retry sleep, it is called when the consumer closes
+func (h *messageHandler) stop() {
+	h.exitOnce.Do(func() {
+		close(h.exit)
+	})
+}
+
+// handle processes msg, it returns false when the handler was stopped or done
+// was closed before the message was done with so its offset must not be marked
+func (h *messageHandler) handle(done <-chan struct{}, msg *sarama.ConsumerMessage) bool {
+	if h.log != nil {
+		h.log.Debugf("receive partition: %d，offset: %d point: %p", msg.Partition, msg.Offset, msg)
+	}
+	if h.monitorVec != nil {
+		h.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "ok"})
+	}
+	attempts, ok, err := h.processWithRetry(done, msg, func() error {
+		return h.process(msg)
+	})
+	if !ok {
+		return false
+	}
+	if err == nil {
+		return true
+	}
+	if h.log != nil {
+		h.log.Errorf("failed to process message from kafka after %d attempts: %s", attempts, err.Error())
+	}
+	return h.deadLetter(done, msg, err, attempts)
+}
+
+// handleBatch processes msgs as a whole, a failed batch is retried and dead-lettered
+// message by message. It returns false like handle does
+func (h *messageHandler) handleBatch(done <-chan struct{}, msgs []*sarama.ConsumerMessage) bool {
+	if len(msgs) == 0 {
+		return true
+	}
+	first := msgs[0]
+	if h.log != nil {
+		h.log.Debugf("receive batch partition: %d，offset: %d-%d size: %d", first.Partition, first.Offset, msgs[len(msgs)-1].Offset, len(msgs))
+	}
+	if h.monitorVec != nil {
+		for _, msg := range msgs {
+			h.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "ok"})
+		}
+	}
+	if h.batchVec != nil {
+		h.batchVec.ObserveSize(&monitor.KafkaBatchLabels{Topic: first.Topic}, float64(len(msgs)))
+	}
+	start := time.Now()
+	attempts, ok, err := h.processWithRetry(done, first, func() error {
+		return h.batchProcess(msgs)
+	})
+	if h.batchVec != nil {
+		h.batchVec.ObserveLatency(&monitor.KafkaBatchLabels{Topic: first.Topic}, float64(time.Since(start).Milliseconds()))
+	}
+	if !ok {
+		return false
+	}
+	if err == nil {
+		return true
+	}
+	if h.log != nil {
+		h.log.Errorf("failed to process batch from kafka after %d attempts: %s", attempts, err.Error())
+	}
+	for _, msg := range msgs {
+		if !h.deadLetter(done, msg, err, attempts) {
+			return false
+		}
+	}
+	return true
+}
+
+// processWithRetry calls fn until it succeeds or the retry policy gives up, in
+// strict mode without dead-letter topic it only gives up on errors the policy
+// does not retry, Permanent ones by default.
+// msg is the message or the first message of the batch being processed. ok is
+// false if the handler was stopped or done was closed meanwhile
+func (h *messageHandler) processWithRetry(done <-chan struct{}, msg *sarama.ConsumerMessage, fn func() error) (attempts int, ok bool, err error) {
+	for {
+		err = fn()
+		attempts++
+		if err == nil {
+			return attempts, true, nil
+		}
+		policy := h.retry
+		if !policy.retryable(err, attempts) {
+			// strict mode only outlasts MaxAttempts, not the classifier
+			if !h.strict || h.dlqProducer != nil || !policy.classify(err) {
+				return attempts, true, err
+			}
+			if policy == nil || policy.InitialBackoff <= 0 {
+				policy = &strictRetryPolicy
+			}
+		}
+		if h.monitorVec != nil {
+			h.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "reprocess"})
+		}
+		if h.log != nil {
+			h.log.Warnf("retry message t:%s,p:%d,o:%d attempt %d: %s", msg.Topic, msg.Partition, msg.Offset, attempts, err.Error())
+		}
+		if !h.sleep(done, policy.backoff(attempts)) {
+			return attempts, false, err
+		}
+	}
+}
+
+// sleep waits for d, it returns false if the handler was stopped or done was
+// closed meanwhile
+func (h *messageHandler) sleep(done <-chan struct{}, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-h.exit:
+		return false
+	case <-done:
+		return false
+	}
+}
+
+// deadLetter republishes msg to the dead-letter topic and waits for the broker
+// acknowledgement, a failed publish is sent again until it is acknowledged so
+// the offset of msg is only marked once it is in the dead-letter topic. Out of
+// strict mode msg is dropped instead when the publish error cannot be retried.
+// It returns false like handle does, true when no dead-letter topic is set
+func (h *messageHandler) deadLetter(done <-chan struct{}, msg *sarama.ConsumerMessage, err error, attempts int) bool {
+	if h.dlqProducer == nil {
+		return true
+	}
+	ctx, cancel := h.context(done)
+	defer cancel()
+	policy := h.retry
+	if policy == nil || policy.InitialBackoff <= 0 {
+		policy = &strictRetryPolicy
+	}
+	for i := 1; ; i++ {
+		_, _, e := h.dlqProducer.SendSync(ctx, h.deadLetterMessage(msg, err, attempts))
+		if e == nil {
+			break
+		}
+		if h.monitorVec != nil {
+			h.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "dlqerror"})
+		}
+		if h.log != nil {
+			h.log.Errorf("failed to send message to dead-letter topic %s t:%s,p:%d,o:%d attempt %d: %s", h.dlqTopic, msg.Topic, msg.Partition, msg.Offset, i, e.Error())
+		}
+		if !h.strict && !deadLetterRetriable(e) {
+			if h.log != nil {
+				h.log.Errorf("drop message t:%s,p:%d,o:%d, the dead-letter publish cannot succeed", msg.Topic, msg.Partition, msg.Offset)
+			}
+			return true
+		}
+		if !h.sleep(done, policy.backoff(i)) {
+			return false
+		}
+	}
+	if h.monitorVec != nil {
+		h.monitorVec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "dlq"})
+	}
+	if h.log != nil {
+		h.log.Warnf("send message to dead-letter topic %s t:%s,p:%d,o:%d", h.dlqTopic, msg.Topic, msg.Partition, msg.Offset)
+	}
+	return true
+}
+
+// deadLetterRetriable reports whether a failed dead-letter publish may succeed
+// when sent again, network errors and broker errors are retried except the
+// ones caused by the message or the configuration
+func deadLetterRetriable(err error) bool {
+	if errors.As(err, new(sarama.ConfigurationError)) {
+		return false
+	}
+	var kerr sarama.KError
+	if !errors.As(err, &kerr) {
+		return true
+	}
+	switch kerr {
+	case sarama.ErrMessageSizeTooLarge, sarama.ErrMessageSetSizeTooLarge, sarama.ErrInvalidTopic,
+		sarama.ErrInvalidRecord, sarama.ErrInvalidRequiredAcks, sarama.ErrPolicyViolation,
+		sarama.ErrUnsupportedVersion, sarama.ErrUnsupportedForMessageFormat,
+		sarama.ErrTopicAuthorizationFailed, sarama.ErrClusterAuthorizationFailed, sarama.ErrSASLAuthenticationFailed:
+		return false
+	}
+	return true
+}
+
+func (h *messageHandler) deadLetterMessage(msg *sarama.ConsumerMessage, err error, attempts int) *sarama.ProducerMessage {
+	dm := &sarama.ProducerMessage{
+		Topic:   h.dlqTopic,
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: make([]sarama.RecordHeader, 0, len(msg.Headers)+5),
+	}
+	if msg.Key != nil {
+		dm.Key = sarama.ByteEncoder(msg.Key)
+	}
+	for _, rh := range msg.Headers {
+		if rh != nil {
+			dm.Headers = append(dm.Headers, *rh)
+		}
+	}
+	dm.Headers = append(dm.Headers,
+		sarama.RecordHeader{Key: []byte(DLQHeaderTopic), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte(DLQHeaderPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte(DLQHeaderOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(DLQHeaderError), Value: []byte(err.Error())},
+		sarama.RecordHeader{Key: []byte(DLQHeaderAttempts), Value: []byte(strconv.Itoa(attempts))},
+	)
+	return dm
+}
+
+// context is cancelled when the handler is stopped or done is closed
+func (h *messageHandler) context(done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-done:
+		case <-h.exit:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
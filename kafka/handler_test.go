@@ -0,0 +1,153 @@
+package kafka
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// recordProducer acknowledges the messages sent to it and records them, the
+// first fail messages fail with err
+type recordProducer struct {
+	// the transaction methods are not called
+	sarama.AsyncProducer
+	mu        sync.Mutex
+	fail      int
+	err       sarama.KError
+	sent      []*sarama.ProducerMessage
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newRecordProducer(fail int) *recordProducer {
+	p := &recordProducer{
+		fail:      fail,
+		err:       sarama.ErrNotLeaderForPartition,
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+	}
+	go func() {
+		for msg := range p.input {
+			p.mu.Lock()
+			failed, err := p.fail > 0, p.err
+			if failed {
+				p.fail--
+			} else {
+				p.sent = append(p.sent, msg)
+			}
+			p.mu.Unlock()
+			if failed {
+				p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			} else {
+				p.successes <- msg
+			}
+		}
+		close(p.successes)
+		close(p.errors)
+	}()
+	return p
+}
+
+func (p *recordProducer) messages() []*sarama.ProducerMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*sarama.ProducerMessage(nil), p.sent...)
+}
+
+func (p *recordProducer) AsyncClose()                               { close(p.input) }
+func (p *recordProducer) Close() error                              { close(p.input); return nil }
+func (p *recordProducer) Input() chan<- *sarama.ProducerMessage     { return p.input }
+func (p *recordProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+func (p *recordProducer) Errors() <-chan *sarama.ProducerError      { return p.errors }
+
+func TestHandlerDeadLetter(t *testing.T) {
+	rp := newRecordProducer(2)
+	dlq := newMockProducer(t, rp)
+	defer dlq.Close()
+	options := &Options{dlqTopic: "test-dlq", dlqProducer: dlq, retry: &RetryPolicy{InitialBackoff: time.Millisecond}}
+	h := newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+		return errors.New("boom")
+	})
+	// the failed publishes are sent again before the message is marked
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test", Partition: 3, Offset: 42, Key: []byte("k"), Value: []byte("v")}) {
+		t.Fatal("dead-lettered message not marked")
+	}
+	sent := rp.messages()
+	if len(sent) != 1 {
+		t.Fatalf("dead-letter messages %d", len(sent))
+	}
+	msg := sent[0]
+	if msg.Topic != "test-dlq" {
+		t.Errorf("topic %s", msg.Topic)
+	}
+	want := map[string]string{
+		DLQHeaderTopic:     "test",
+		DLQHeaderPartition: "3",
+		DLQHeaderOffset:    "42",
+		DLQHeaderError:     "boom",
+		DLQHeaderAttempts:  "1",
+	}
+	for _, rh := range msg.Headers {
+		if v, ok := want[string(rh.Key)]; ok && v != string(rh.Value) {
+			t.Errorf("header %s = %s, want %s", rh.Key, rh.Value, v)
+		}
+		delete(want, string(rh.Key))
+	}
+	if len(want) > 0 {
+		t.Errorf("missing headers %v", want)
+	}
+
+	// a message whose dead-letter publish is not acknowledged is not marked
+	h = newMessageHandler(&Options{dlqTopic: "test-dlq", dlqProducer: newMockProducer(t, newRecordProducer(1<<30)),
+		retry: &RetryPolicy{InitialBackoff: time.Millisecond}}, func(*sarama.ConsumerMessage) error {
+		return errors.New("boom")
+	})
+	done := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(done) })
+	if h.handle(done, &sarama.ConsumerMessage{Topic: "test"}) {
+		t.Error("message marked without dead-letter acknowledgement")
+	}
+}
+
+func TestHandlerDeadLetterPermanent(t *testing.T) {
+	newHandler := func(rp *recordProducer, strict bool) *messageHandler {
+		return newMessageHandler(&Options{dlqTopic: "test-dlq", dlqProducer: newMockProducer(t, rp), strict: strict,
+			retry: &RetryPolicy{InitialBackoff: time.Millisecond}}, func(*sarama.ConsumerMessage) error {
+			return errors.New("boom")
+		})
+	}
+	// a dead-letter message too large for the broker is dropped at once
+	rp := newRecordProducer(1 << 30)
+	rp.err = sarama.ErrMessageSizeTooLarge
+	h := newHandler(rp, false)
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test"}) {
+		t.Error("message not marked after a permanent dead-letter error")
+	}
+	rp.mu.Lock()
+	if failed := 1<<30 - rp.fail; failed != 1 {
+		t.Errorf("dead-letter publishes %d, want 1", failed)
+	}
+	rp.mu.Unlock()
+
+	// strict mode keeps the offset until the message is dead-lettered
+	rp = newRecordProducer(1 << 30)
+	rp.err = sarama.ErrTopicAuthorizationFailed
+	h = newHandler(rp, true)
+	done := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(done) })
+	if h.handle(done, &sarama.ConsumerMessage{Topic: "test"}) {
+		t.Error("strict message marked without dead-letter acknowledgement")
+	}
+}
+
+func TestHandlerNoDeadLetter(t *testing.T) {
+	h := newMessageHandler(&Options{}, func(*sarama.ConsumerMessage) error {
+		return errors.New("boom")
+	})
+	h.handle(nil, &sarama.ConsumerMessage{Topic: "test"})
+}
@@ -0,0 +1,12 @@
+/*
+Package cluster provides cluster extensions for Sarama, enabing users
+to consume topics across from multiple, balanced nodes.
+
+It requires Kafka v0.9+ and follows the steps guide, described in:
+https://cwiki.apache.org/confluence/display/KAFKA/Kafka+0.9+Consumer+Rewrite+Design
+
+It is a copy of github.com/bsm/sarama-cluster v2.1.15, the project is archived
+and does not build with the sarama versions supporting static membership. The
+offset commit passes the leader epoch added to OffsetCommitRequest.AddBlock.
+*/
+package cluster
@@ -0,0 +1,387 @@
+package kafkatest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// maxFetchRecords bounds the records of a partition in a fetch response
+const maxFetchRecords = 500
+
+func (c *Cluster) accept() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		c.connMu.Lock()
+		if c.down {
+			conn.Close()
+			c.connMu.Unlock()
+			continue
+		}
+		c.conns[conn] = true
+		c.connMu.Unlock()
+		c.wg.Add(1)
+		go c.handle(conn)
+	}
+}
+
+// handle answers the requests of a client connection. The cluster decodes a
+// request and builds its response, a mock broker of the connection encodes it
+func (c *Cluster) handle(conn net.Conn) {
+	defer c.wg.Done()
+	defer conn.Close()
+	defer func() {
+		c.connMu.Lock()
+		delete(c.conns, conn)
+		c.connMu.Unlock()
+	}()
+
+	mock := sarama.NewMockBroker(c.t, brokerID)
+	defer mock.Close()
+	upstream, err := net.Dial("tcp", mock.Addr())
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		req, err := decodeRequest(frame)
+		if err != nil {
+			c.t.Errorf("kafkatest: %v", err)
+			return
+		}
+		c.mu.Lock()
+		res := c.respond(req)
+		c.mu.Unlock()
+		if res == nil {
+			continue
+		}
+		mock.SetHandlerByMap(map[string]sarama.MockResponse{apis[req.key].name: res})
+		data, err := exchange(upstream, frame)
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 4+binary.BigEndian.Uint32(size))
+	copy(frame, size)
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// exchange sends a request frame to the mock broker and reads the response
+// it encoded
+func exchange(upstream net.Conn, req []byte) ([]byte, error) {
+	if err := upstream.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return nil, err
+	}
+	if _, err := upstream.Write(req); err != nil {
+		return nil, err
+	}
+	return readFrame(upstream)
+}
+
+// await waits until done or timeout, it waits until the cluster is closed
+// when timeout is 0. c.mu is held and released while waiting
+func (c *Cluster) await(timeout time.Duration, done func() bool) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for !done() {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+			c.mu.Lock()
+		case <-expired:
+			c.mu.Lock()
+			return done()
+		case <-c.closing:
+			c.mu.Lock()
+			return false
+		}
+	}
+	return true
+}
+
+// respond builds the response of a request from the state of the cluster and
+// applies the request, it returns nil for the requests the cluster does not
+// answer and when the client expects no response. c.mu is held
+func (c *Cluster) respond(req *request) sarama.MockResponse {
+	if a, ok := apis[req.key]; !ok || req.version > a.maxVersion {
+		return nil
+	}
+	version := req.version
+	switch req.key {
+	case apiApiVersions:
+		return sarama.NewMockWrapper(c.apiVersions(version))
+	case apiMetadata:
+		return sarama.NewMockWrapper(c.metadata(req.body.(*metadataRequest), version))
+	case apiFindCoordinator:
+		return sarama.NewMockWrapper(&sarama.FindCoordinatorResponse{Version: version, Coordinator: c.self})
+	case apiInitProducerID:
+		c.producerID++
+		return sarama.NewMockWrapper(&sarama.InitProducerIDResponse{ProducerID: c.producerID})
+	case apiProduce:
+		produce := req.body.(*produceRequest)
+		res := c.produce(produce, version)
+		if produce.acks == 0 {
+			return nil
+		}
+		return sarama.NewMockWrapper(res)
+	case apiFetch:
+		fetch := req.body.(*fetchRequest)
+		c.await(fetch.maxWait, func() bool { return c.fetchable(fetch) })
+		return sarama.NewMockWrapper(c.fetch(fetch, version))
+	case apiListOffsets:
+		return sarama.NewMockWrapper(c.listOffsets(req.body.(*listOffsetsRequest), version))
+	case apiJoinGroup:
+		return sarama.NewMockWrapper(c.joinGroup(req.body.(*joinGroupRequest), version))
+	case apiSyncGroup:
+		return sarama.NewMockWrapper(c.syncGroup(req.body.(*syncGroupRequest), version))
+	case apiHeartbeat:
+		return sarama.NewMockWrapper(c.heartbeat(req.body.(*heartbeatRequest), version))
+	case apiLeaveGroup:
+		return sarama.NewMockWrapper(c.leaveGroup(req.body.(*leaveGroupRequest), version))
+	case apiOffsetCommit:
+		return sarama.NewMockWrapper(c.commit(req.body.(*offsetCommitRequest), version))
+	case apiOffsetFetch:
+		return sarama.NewMockWrapper(c.offsetFetch(req.body.(*offsetFetchRequest), version))
+	}
+	return nil
+}
+
+func (c *Cluster) apiVersions(version int16) *sarama.ApiVersionsResponse {
+	res := &sarama.ApiVersionsResponse{Version: version}
+	for key, a := range apis {
+		res.ApiKeys = append(res.ApiKeys, sarama.ApiVersionsResponseKey{Version: version, ApiKey: key, MaxVersion: a.maxVersion})
+	}
+	sort.Slice(res.ApiKeys, func(i, j int) bool { return res.ApiKeys[i].ApiKey < res.ApiKeys[j].ApiKey })
+	return res
+}
+
+func (c *Cluster) metadata(req *metadataRequest, version int16) *sarama.MetadataResponse {
+	res := &sarama.MetadataResponse{Version: version, ControllerID: brokerID}
+	res.AddBroker(c.self.Addr(), brokerID)
+	topics := req.topics
+	if req.all {
+		topics = c.sortedTopics()
+	}
+	replicas := []int32{brokerID}
+	for _, topic := range topics {
+		if _, ok := c.topics[topic]; !ok && req.autoCreate {
+			c.createTopic(topic, 1)
+		}
+		log, ok := c.topics[topic]
+		if !ok {
+			res.AddTopic(topic, sarama.ErrUnknownTopicOrPartition)
+			continue
+		}
+		for partition := range log {
+			res.AddTopicPartition(topic, int32(partition), brokerID, replicas, replicas, nil, sarama.ErrNoError)
+		}
+	}
+	return res
+}
+
+func (c *Cluster) produce(req *produceRequest, version int16) *sarama.ProduceResponse {
+	res := &sarama.ProduceResponse{Version: version, Blocks: make(map[string]map[int32]*sarama.ProduceResponseBlock)}
+	for topic, partitions := range req.records {
+		res.Blocks[topic] = make(map[int32]*sarama.ProduceResponseBlock)
+		for partition, msgs := range partitions {
+			block := &sarama.ProduceResponseBlock{Offset: -1}
+			switch {
+			case !c.exists(topic, partition):
+				block.Err = sarama.ErrUnknownTopicOrPartition
+			case c.produceErrors[topicPartition{topic, partition}] != sarama.ErrNoError:
+				block.Err = c.produceErrors[topicPartition{topic, partition}]
+			default:
+				block.Offset = c.append(topic, partition, msgs)
+			}
+			res.Blocks[topic][partition] = block
+		}
+	}
+	return res
+}
+
+// fetchable reports whether a fetch is answered at once
+func (c *Cluster) fetchable(req *fetchRequest) bool {
+	for topic, partitions := range req.offsets {
+		for partition, offset := range partitions {
+			if !c.exists(topic, partition) || c.fetchErrors[topicPartition{topic, partition}] != sarama.ErrNoError ||
+				offset != int64(len(c.topics[topic][partition])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Cluster) fetch(req *fetchRequest, version int16) *sarama.FetchResponse {
+	res := &sarama.FetchResponse{Version: version}
+	for topic, partitions := range req.offsets {
+		for partition, offset := range partitions {
+			res.AddError(topic, partition, sarama.ErrNoError)
+			block := res.GetBlock(topic, partition)
+			block.PreferredReadReplica = -1
+			if !c.exists(topic, partition) {
+				block.Err = sarama.ErrUnknownTopicOrPartition
+				continue
+			}
+			log := c.topics[topic][partition]
+			hwm := int64(len(log))
+			block.HighWaterMarkOffset = hwm
+			block.LastStableOffset = hwm
+			if err := c.fetchErrors[topicPartition{topic, partition}]; err != sarama.ErrNoError {
+				block.Err = err
+				continue
+			}
+			if offset < 0 || offset > hwm {
+				block.Err = sarama.ErrOffsetOutOfRange
+				continue
+			}
+			end := offset + maxFetchRecords
+			if end > hwm {
+				end = hwm
+			}
+			if offset < end {
+				block.RecordsSet = []*sarama.Records{fetchRecords(log[offset:end], version)}
+			}
+		}
+	}
+	return res
+}
+
+// fetchRecords encodes msgs as a record batch, or a message set before fetch v4
+func fetchRecords(msgs []*sarama.ConsumerMessage, version int16) *sarama.Records {
+	if version < 4 {
+		set := &sarama.MessageSet{}
+		for _, msg := range msgs {
+			m := &sarama.Message{Key: msg.Key, Value: msg.Value}
+			if version >= 2 {
+				m.Version = 1
+				m.Timestamp = msg.Timestamp
+			}
+			set.Messages = append(set.Messages, &sarama.MessageBlock{Offset: msg.Offset, Msg: m})
+		}
+		return &sarama.Records{MsgSet: set}
+	}
+	first := msgs[0]
+	batch := &sarama.RecordBatch{
+		Version:         2,
+		FirstOffset:     first.Offset,
+		LastOffsetDelta: int32(len(msgs) - 1),
+		FirstTimestamp:  first.Timestamp,
+		MaxTimestamp:    first.Timestamp,
+		ProducerID:      -1,
+		ProducerEpoch:   -1,
+		FirstSequence:   -1,
+	}
+	for i, msg := range msgs {
+		if msg.Timestamp.After(batch.MaxTimestamp) {
+			batch.MaxTimestamp = msg.Timestamp
+		}
+		batch.Records = append(batch.Records, &sarama.Record{
+			OffsetDelta:    int64(i),
+			TimestampDelta: msg.Timestamp.Sub(first.Timestamp),
+			Key:            msg.Key,
+			Value:          msg.Value,
+			Headers:        msg.Headers,
+		})
+	}
+	return &sarama.Records{RecordBatch: batch}
+}
+
+func (c *Cluster) listOffsets(req *listOffsetsRequest, version int16) *sarama.OffsetResponse {
+	res := &sarama.OffsetResponse{Version: version, Blocks: make(map[string]map[int32]*sarama.OffsetResponseBlock)}
+	for topic, partitions := range req.times {
+		res.Blocks[topic] = make(map[int32]*sarama.OffsetResponseBlock)
+		for partition, t := range partitions {
+			if !c.exists(topic, partition) {
+				res.Blocks[topic][partition] = &sarama.OffsetResponseBlock{Err: sarama.ErrUnknownTopicOrPartition}
+				continue
+			}
+			log := c.topics[topic][partition]
+			offset := int64(len(log))
+			switch t {
+			case sarama.OffsetOldest:
+				offset = 0
+			case sarama.OffsetNewest:
+			default:
+				// the first message at or after the time
+				offset = int64(sort.Search(len(log), func(i int) bool {
+					return log[i].Timestamp.UnixNano()/int64(time.Millisecond) >= t
+				}))
+			}
+			res.Blocks[topic][partition] = &sarama.OffsetResponseBlock{Offsets: []int64{offset}, Offset: offset, Timestamp: -1}
+		}
+	}
+	return res
+}
+
+func (c *Cluster) commit(req *offsetCommitRequest, version int16) *sarama.OffsetCommitResponse {
+	g := c.group(req.group)
+	res := &sarama.OffsetCommitResponse{Version: version}
+	for topic, offsets := range req.offsets {
+		for partition, offset := range offsets {
+			tp := topicPartition{topic, partition}
+			err := c.commitErrors[req.group][tp]
+			if err == sarama.ErrNoError {
+				err = c.commitError(g, req.member, req.generation)
+			}
+			if err == sarama.ErrNoError {
+				g.committed[tp] = offset
+			}
+			res.AddError(topic, partition, err)
+		}
+	}
+	c.notify()
+	return res
+}
+
+func (c *Cluster) offsetFetch(req *offsetFetchRequest, version int16) *sarama.OffsetFetchResponse {
+	res := &sarama.OffsetFetchResponse{Version: version}
+	partitions := req.partitions
+	if partitions == nil {
+		partitions = make(map[string][]int32)
+		if g := c.groups[req.group]; g != nil {
+			for tp := range g.committed {
+				partitions[tp.topic] = append(partitions[tp.topic], tp.partition)
+			}
+		}
+	}
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			res.AddBlock(topic, partition, &sarama.OffsetFetchResponseBlock{
+				Offset:      c.committed(req.group, topic, partition),
+				LeaderEpoch: -1,
+			})
+		}
+	}
+	return res
+}
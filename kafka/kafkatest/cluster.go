@@ -0,0 +1,297 @@
+// Package kafkatest runs an in-process single broker kafka cluster so the
+// consumers and producers of the kafka package can be tested without a broker.
+// Pass Addrs to NewConsumerV2 or NewProducerV2 as the brokers. Consumer groups
+// have any number of members and rebalance like on a broker.
+package kafkatest
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const brokerID = 1
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// Cluster is a kafka cluster answering the requests of the sarama clients.
+// Topics are created with one partition when first asked for
+type Cluster struct {
+	t        sarama.TestReporter
+	listener net.Listener
+	self     *sarama.Broker
+	closing  chan struct{}
+	wg       sync.WaitGroup
+
+	connMu sync.Mutex
+	conns  map[net.Conn]bool
+	down   bool
+
+	mu            sync.Mutex
+	changed       chan struct{}
+	members       int
+	producerID    int64
+	topics        map[string][][]*sarama.ConsumerMessage
+	groups        map[string]*group
+	produceErrors map[topicPartition]sarama.KError
+	fetchErrors   map[topicPartition]sarama.KError
+	commitErrors  map[string]map[topicPartition]sarama.KError
+}
+
+func NewCluster(t sarama.TestReporter) *Cluster {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &sarama.MetadataResponse{}
+	md.AddBroker(listener.Addr().String(), brokerID)
+	c := &Cluster{
+		t:             t,
+		listener:      listener,
+		self:          md.Brokers[0],
+		closing:       make(chan struct{}),
+		conns:         make(map[net.Conn]bool),
+		changed:       make(chan struct{}),
+		topics:        make(map[string][][]*sarama.ConsumerMessage),
+		groups:        make(map[string]*group),
+		produceErrors: make(map[topicPartition]sarama.KError),
+		fetchErrors:   make(map[topicPartition]sarama.KError),
+		commitErrors:  make(map[string]map[topicPartition]sarama.KError),
+	}
+	c.wg.Add(2)
+	go c.accept()
+	go c.expire()
+	return c
+}
+
+// Addrs returns the broker addresses of the cluster
+func (c *Cluster) Addrs() []string {
+	return []string{c.listener.Addr().String()}
+}
+
+func (c *Cluster) Close() {
+	close(c.closing)
+	c.listener.Close()
+	c.connMu.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.connMu.Unlock()
+	c.wg.Wait()
+}
+
+// SetDown makes the cluster unreachable, its connections are closed and new
+// ones are closed once accepted until it is set up again
+func (c *Cluster) SetDown(down bool) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	c.down = down
+	if down {
+		for conn := range c.conns {
+			conn.Close()
+		}
+	}
+}
+
+// CreateTopic creates topic or adds partitions up to partitions
+func (c *Cluster) CreateTopic(topic string, partitions int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.createTopic(topic, partitions)
+}
+
+// Produce appends a message to the partition and returns its offset
+func (c *Cluster) Produce(topic string, partition int32, key, value []byte) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.createTopic(topic, 1)
+	if !c.exists(topic, partition) {
+		c.t.Errorf("kafkatest: partition %d of %s does not exist", partition, topic)
+		return -1
+	}
+	return c.append(topic, partition, []*sarama.ConsumerMessage{{Key: key, Value: value, Timestamp: time.Now()}})
+}
+
+// Messages returns the messages of topic ordered by partition and offset
+func (c *Cluster) Messages(topic string) []*sarama.ConsumerMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var msgs []*sarama.ConsumerMessage
+	for _, log := range c.topics[topic] {
+		msgs = append(msgs, log...)
+	}
+	return msgs
+}
+
+// WaitMessages waits until topic has n messages and returns them, it returns
+// the messages there are after timeout
+func (c *Cluster) WaitMessages(topic string, n int, timeout time.Duration) []*sarama.ConsumerMessage {
+	var msgs []*sarama.ConsumerMessage
+	c.wait(timeout, func() bool {
+		msgs = nil
+		for _, log := range c.topics[topic] {
+			msgs = append(msgs, log...)
+		}
+		return len(msgs) >= n
+	})
+	return msgs
+}
+
+// Committed returns the offset committed by group, -1 when none
+func (c *Cluster) Committed(group, topic string, partition int32) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.committed(group, topic, partition)
+}
+
+// WaitCommitted waits until group committed offset or later
+func (c *Cluster) WaitCommitted(group, topic string, partition int32, offset int64, timeout time.Duration) bool {
+	return c.wait(timeout, func() bool {
+		return c.committed(group, topic, partition) >= offset
+	})
+}
+
+// Generation returns the generation of group, 0 before the first join
+func (c *Cluster) Generation(group string) int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if g := c.groups[group]; g != nil {
+		return g.generation
+	}
+	return 0
+}
+
+// WaitGeneration waits until the members of group synced generation
+func (c *Cluster) WaitGeneration(group string, generation int32, timeout time.Duration) bool {
+	return c.wait(timeout, func() bool {
+		g := c.groups[group]
+		return g != nil && g.generation >= generation && g.state == groupStable
+	})
+}
+
+// Members returns the member ids of group in the order they joined
+func (c *Cluster) Members(group string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var members []string
+	if g := c.groups[group]; g != nil {
+		for _, m := range g.sortedMembers() {
+			members = append(members, m.id)
+		}
+	}
+	return members
+}
+
+// SetProduceError fails the produce requests of the partition with err,
+// sarama.ErrNoError clears it
+func (c *Cluster) SetProduceError(topic string, partition int32, err sarama.KError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.produceErrors[topicPartition{topic, partition}] = err
+}
+
+// SetFetchError fails the fetch requests of the partition with err
+func (c *Cluster) SetFetchError(topic string, partition int32, err sarama.KError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetchErrors[topicPartition{topic, partition}] = err
+	c.notify()
+}
+
+// SetCommitError fails the offset commits of group for the partition with err
+func (c *Cluster) SetCommitError(group, topic string, partition int32, err sarama.KError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.commitErrors[group] == nil {
+		c.commitErrors[group] = make(map[topicPartition]sarama.KError)
+	}
+	c.commitErrors[group][topicPartition{topic, partition}] = err
+}
+
+// Rebalance makes the heartbeats of group fail so its members rejoin. The
+// members are given assignment on rejoin, nil keeps the plan of the leader
+func (c *Cluster) Rebalance(group string, assignment map[string][]int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.group(group)
+	g.assignment = assignment
+	if g.state == groupStable || g.state == groupCompleting {
+		c.prepareRebalance(g)
+	}
+}
+
+func (c *Cluster) wait(timeout time.Duration, done func() bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.await(timeout, done)
+}
+
+// notify wakes the waiters after a change of the cluster, c.mu is held
+func (c *Cluster) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *Cluster) createTopic(topic string, partitions int32) {
+	log := c.topics[topic]
+	for int32(len(log)) < partitions {
+		log = append(log, nil)
+	}
+	c.topics[topic] = log
+}
+
+func (c *Cluster) exists(topic string, partition int32) bool {
+	return partition >= 0 && partition < int32(len(c.topics[topic]))
+}
+
+func (c *Cluster) sortedTopics() []string {
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// append assigns the offsets of msgs and returns the first one
+func (c *Cluster) append(topic string, partition int32, msgs []*sarama.ConsumerMessage) int64 {
+	log := c.topics[topic][partition]
+	base := int64(len(log))
+	for i, msg := range msgs {
+		msg.Topic = topic
+		msg.Partition = partition
+		msg.Offset = base + int64(i)
+		log = append(log, msg)
+	}
+	c.topics[topic][partition] = log
+	c.notify()
+	return base
+}
+
+func (c *Cluster) group(name string) *group {
+	g := c.groups[name]
+	if g == nil {
+		g = &group{
+			members:   make(map[string]*member),
+			instances: make(map[string]string),
+			committed: make(map[topicPartition]int64),
+		}
+		c.groups[name] = g
+	}
+	return g
+}
+
+func (c *Cluster) committed(group, topic string, partition int32) int64 {
+	if g := c.groups[group]; g != nil {
+		if offset, ok := g.committed[topicPartition{topic, partition}]; ok {
+			return offset
+		}
+	}
+	return -1
+}
@@ -0,0 +1,354 @@
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func testConfig() *sarama.Config {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_1_0_0
+	config.Producer.Return.Successes = true
+	config.Producer.Retry.Max = 0
+	config.Producer.Partitioner = sarama.NewManualPartitioner
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Offsets.AutoCommit.Interval = 10 * time.Millisecond
+	config.Consumer.Group.Heartbeat.Interval = 50 * time.Millisecond
+	return config
+}
+
+func TestClusterProduce(t *testing.T) {
+	c := NewCluster(t)
+	defer c.Close()
+	c.CreateTopic("events", 2)
+
+	producer, err := sarama.NewSyncProducer(c.Addrs(), testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+	for i := 0; i < 3; i++ {
+		partition, offset, err := producer.SendMessage(&sarama.ProducerMessage{
+			Topic:     "events",
+			Partition: 1,
+			Key:       sarama.StringEncoder("key"),
+			Value:     sarama.StringEncoder("value"),
+			Headers:   []sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v")}},
+		})
+		if err != nil || partition != 1 || offset != int64(i) {
+			t.Fatalf("partition %d offset %d err %v", partition, offset, err)
+		}
+	}
+	msgs := c.Messages("events")
+	if len(msgs) != 3 || msgs[2].Offset != 2 || string(msgs[0].Key) != "key" || string(msgs[0].Value) != "value" {
+		t.Fatalf("messages %v", msgs)
+	}
+	if len(msgs[0].Headers) != 1 || string(msgs[0].Headers[0].Value) != "v" {
+		t.Errorf("headers %v", msgs[0].Headers)
+	}
+
+	// unknown topics are created
+	if _, _, err = producer.SendMessage(&sarama.ProducerMessage{Topic: "auto", Value: sarama.StringEncoder("v")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Messages("auto")) != 1 {
+		t.Error("message to a new topic not stored")
+	}
+
+	c.SetProduceError("events", 0, sarama.ErrMessageSizeTooLarge)
+	_, _, err = producer.SendMessage(&sarama.ProducerMessage{Topic: "events", Partition: 0, Value: sarama.StringEncoder("v")})
+	if !errors.Is(err, sarama.ErrMessageSizeTooLarge) {
+		t.Errorf("produce error %v", err)
+	}
+}
+
+func TestClusterCompression(t *testing.T) {
+	c := NewCluster(t)
+	defer c.Close()
+	codecs := []sarama.CompressionCodec{sarama.CompressionGZIP, sarama.CompressionSnappy, sarama.CompressionLZ4, sarama.CompressionZSTD}
+	for _, codec := range codecs {
+		// message sets before kafka 0.11, record batches after
+		for _, version := range []sarama.KafkaVersion{sarama.V0_10_2_0, sarama.V2_1_0_0} {
+			if codec == sarama.CompressionZSTD && version == sarama.V0_10_2_0 {
+				continue
+			}
+			config := testConfig()
+			config.Version = version
+			config.Producer.Compression = codec
+			producer, err := sarama.NewSyncProducer(c.Addrs(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			topic := fmt.Sprintf("%s-%s", codec, version)
+			msgs := []*sarama.ProducerMessage{
+				{Topic: topic, Key: sarama.StringEncoder("k"), Value: sarama.StringEncoder("a")},
+				{Topic: topic, Value: sarama.StringEncoder("b")},
+			}
+			if err = producer.SendMessages(msgs); err != nil {
+				t.Fatalf("%s: %v", topic, err)
+			}
+			producer.Close()
+			got := c.Messages(topic)
+			if len(got) != 2 || string(got[0].Key) != "k" || string(got[0].Value) != "a" || string(got[1].Value) != "b" {
+				t.Errorf("%s: messages %v", topic, got)
+			}
+		}
+	}
+}
+
+func TestClusterConsume(t *testing.T) {
+	c := NewCluster(t)
+	defer c.Close()
+	c.CreateTopic("events", 2)
+	c.Produce("events", 0, nil, []byte("a"))
+	c.Produce("events", 1, nil, []byte("b"))
+
+	consumer, err := sarama.NewConsumer(c.Addrs(), testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	pc, err := consumer.ConsumePartition("events", 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if msg := <-pc.Messages(); string(msg.Value) != "a" || msg.Offset != 0 {
+		t.Errorf("message %s at %d", msg.Value, msg.Offset)
+	}
+	// a fetch waits for the next message
+	go c.Produce("events", 0, []byte("k"), []byte("c"))
+	select {
+	case msg := <-pc.Messages():
+		if string(msg.Value) != "c" || string(msg.Key) != "k" || msg.Offset != 1 {
+			t.Errorf("message %s at %d", msg.Value, msg.Offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("produced message not consumed")
+	}
+
+	c.SetFetchError("events", 0, sarama.ErrOffsetOutOfRange)
+	select {
+	case err := <-pc.Errors():
+		if !errors.Is(err, sarama.ErrOffsetOutOfRange) {
+			t.Errorf("fetch error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch error not returned")
+	}
+
+	client, err := sarama.NewClient(c.Addrs(), testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if offset, err := client.GetOffset("events", 0, sarama.OffsetNewest); err != nil || offset != 2 {
+		t.Errorf("newest offset %d %v", offset, err)
+	}
+}
+
+type groupHandler struct {
+	mu       sync.Mutex
+	claims   []map[string][]int32
+	messages chan *sarama.ConsumerMessage
+}
+
+func (h *groupHandler) Setup(s sarama.ConsumerGroupSession) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.claims = append(h.claims, s.Claims())
+	return nil
+}
+
+func (h *groupHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h *groupHandler) ConsumeClaim(s sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		h.messages <- msg
+		s.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+func (h *groupHandler) lastClaims() map[string][]int32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.claims[len(h.claims)-1]
+}
+
+func TestClusterGroup(t *testing.T) {
+	c := NewCluster(t)
+	defer c.Close()
+	c.CreateTopic("events", 2)
+	c.Produce("events", 0, nil, []byte("a"))
+	c.Produce("events", 1, nil, []byte("b"))
+
+	handler := &groupHandler{messages: make(chan *sarama.ConsumerMessage, 10)}
+	stop := consume(t, c, "group", handler)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handler.messages:
+		case <-time.After(5 * time.Second):
+			t.Fatal("group did not consume")
+		}
+	}
+	if !c.WaitCommitted("group", "events", 0, 1, 5*time.Second) || !c.WaitCommitted("group", "events", 1, 1, 5*time.Second) {
+		t.Fatalf("offsets not committed: %d %d", c.Committed("group", "events", 0), c.Committed("group", "events", 1))
+	}
+	if got := handler.lastClaims()["events"]; len(got) != 2 {
+		t.Errorf("claims %v", got)
+	}
+
+	// the rejoined member only gets partition 1
+	generation := c.Generation("group")
+	c.Rebalance("group", map[string][]int32{"events": {1}})
+	if !c.WaitGeneration("group", generation+1, 5*time.Second) {
+		t.Fatal("group did not rejoin")
+	}
+	c.Produce("events", 1, nil, []byte("c"))
+	select {
+	case msg := <-handler.messages:
+		if string(msg.Value) != "c" {
+			t.Errorf("message %s", msg.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rejoined group did not consume")
+	}
+	if got := handler.lastClaims()["events"]; len(got) != 1 || got[0] != 1 {
+		t.Errorf("claims after rebalance %v", got)
+	}
+
+	if !c.WaitCommitted("group", "events", 1, 2, 5*time.Second) {
+		t.Fatalf("offset not committed after rebalance: %d", c.Committed("group", "events", 1))
+	}
+	c.SetCommitError("group", "events", 1, sarama.ErrOffsetMetadataTooLarge)
+	c.Produce("events", 1, nil, []byte("d"))
+	<-handler.messages
+	time.Sleep(100 * time.Millisecond)
+	if offset := c.Committed("group", "events", 1); offset != 2 {
+		t.Errorf("failed commit stored: %d", offset)
+	}
+
+}
+
+// consume runs a member of group until the returned function is called
+func consume(t *testing.T, c *Cluster, group string, handler *groupHandler) func() {
+	cg, err := sarama.NewConsumerGroup(c.Addrs(), group, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			if err := cg.Consume(ctx, []string{"events"}, handler); err != nil {
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		cg.Close()
+		<-done
+	}
+}
+
+func TestClusterGroupMembers(t *testing.T) {
+	c := NewCluster(t)
+	defer c.Close()
+	c.CreateTopic("events", 2)
+
+	first := &groupHandler{messages: make(chan *sarama.ConsumerMessage, 10)}
+	stopFirst := consume(t, c, "group", first)
+	defer stopFirst()
+	if !c.WaitGeneration("group", 1, 5*time.Second) {
+		t.Fatal("first member did not join")
+	}
+
+	// a second member rebalances the partitions between both
+	second := &groupHandler{messages: make(chan *sarama.ConsumerMessage, 10)}
+	stopSecond := consume(t, c, "group", second)
+	if !c.WaitGeneration("group", 2, 5*time.Second) {
+		t.Fatal("second member did not join")
+	}
+	if members := c.Members("group"); len(members) != 2 {
+		t.Fatalf("members %v", members)
+	}
+	waitClaims := func(h *groupHandler, n int) map[string][]int32 {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			h.mu.Lock()
+			var claims map[string][]int32
+			if len(h.claims) > 0 {
+				claims = h.claims[len(h.claims)-1]
+			}
+			h.mu.Unlock()
+			if len(claims["events"]) == n || time.Now().After(deadline) {
+				return claims
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	a, b := waitClaims(first, 1)["events"], waitClaims(second, 1)["events"]
+	if len(a) != 1 || len(b) != 1 || a[0] == b[0] {
+		t.Fatalf("claims %v %v", a, b)
+	}
+	c.Produce("events", b[0], nil, []byte("b"))
+	select {
+	case msg := <-second.messages:
+		if string(msg.Value) != "b" {
+			t.Errorf("message %s", msg.Value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second member did not consume")
+	}
+
+	// the first member takes all the partitions back once the second left
+	generation := c.Generation("group")
+	stopSecond()
+	if !c.WaitGeneration("group", generation+1, 5*time.Second) {
+		t.Fatal("group did not rebalance after leave")
+	}
+	if members := c.Members("group"); len(members) != 1 {
+		t.Fatalf("members after leave %v", members)
+	}
+	if got := waitClaims(first, 2)["events"]; len(got) != 2 {
+		t.Errorf("claims after leave %v", got)
+	}
+}
+
+func TestClusterDown(t *testing.T) {
+	c := NewCluster(t)
+	defer c.Close()
+	config := testConfig()
+	config.Metadata.Retry.Max = 0
+	client, err := sarama.NewClient(c.Addrs(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c.SetDown(true)
+	if err = client.RefreshMetadata(); err == nil {
+		t.Error("metadata refreshed while down")
+	}
+	if _, err = sarama.NewClient(c.Addrs(), config); err == nil {
+		t.Error("client created while down")
+	}
+	c.SetDown(false)
+	up, err := sarama.NewClient(c.Addrs(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.Close()
+}
@@ -0,0 +1,378 @@
+package kafkatest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// expiryInterval is how often the sessions and the rebalance timeouts of the
+// groups are checked
+const expiryInterval = 20 * time.Millisecond
+
+type groupState int
+
+const (
+	groupEmpty groupState = iota
+	groupPreparing
+	groupCompleting
+	groupStable
+)
+
+type member struct {
+	id        string
+	instance  string
+	seq       int
+	protocols []*sarama.GroupProtocol
+	// pending is set while the member waits for the rebalance it joined
+	pending          bool
+	assignment       []byte
+	session          time.Duration
+	rebalanceTimeout time.Duration
+	heartbeat        time.Time
+}
+
+// group is a consumer group coordinated like a broker does: a join prepares
+// a rebalance that completes once every member joined again or the rebalance
+// timeout evicted the others, the leader then assigns the partitions
+type group struct {
+	state      groupState
+	generation int32
+	protocol   string
+	leader     string
+	deadline   time.Time
+	members    map[string]*member
+	instances  map[string]string
+	assignment map[string][]int32
+	committed  map[topicPartition]int64
+}
+
+func (c *Cluster) joinGroup(req *joinGroupRequest, version int16) *sarama.JoinGroupResponse {
+	res := &sarama.JoinGroupResponse{Version: version, GenerationId: -1}
+	if len(req.protocols) == 0 {
+		res.Err = sarama.ErrInconsistentGroupProtocol
+		return res
+	}
+	g := c.group(req.group)
+	m := g.members[req.member]
+	switch {
+	case req.member == "" && g.instances[req.instance] != "":
+		// a static member restarted, it takes the place of its previous id
+		m = g.members[g.instances[req.instance]]
+		if g.state == groupStable && sameProtocols(m.protocols, req.protocols) {
+			leader := g.leader
+			c.replaceMember(g, m)
+			m.heartbeat = time.Now()
+			res.MemberId = m.id
+			res.LeaderId = leader
+			res.GenerationId = g.generation
+			res.GroupProtocol = g.protocol
+			return res
+		}
+		c.replaceMember(g, m)
+	case req.member == "":
+		c.members++
+		m = &member{id: fmt.Sprintf("kafkatest-member-%d", c.members), instance: req.instance, seq: c.members}
+		g.members[m.id] = m
+		if m.instance != "" {
+			g.instances[m.instance] = m.id
+		}
+	case m == nil:
+		res.Err = sarama.ErrUnknownMemberId
+		return res
+	case req.instance != "" && g.instances[req.instance] != m.id:
+		res.Err = sarama.ErrFencedInstancedId
+		return res
+	case g.state == groupStable && m.id != g.leader && sameProtocols(m.protocols, req.protocols):
+		// a follower rejoining with the same protocols keeps the generation
+		m.heartbeat = time.Now()
+		return c.joinResponse(g, m, res)
+	}
+	m.protocols = req.protocols
+	m.session = req.sessionTimeout
+	m.rebalanceTimeout = req.rebalanceTimeout
+	m.heartbeat = time.Now()
+	m.pending = true
+	if g.state != groupPreparing {
+		c.prepareRebalance(g)
+	}
+	c.maybeCompleteJoin(g)
+
+	c.await(0, func() bool { return g.members[m.id] != m || !m.pending })
+	if g.members[m.id] != m {
+		res.Err = sarama.ErrUnknownMemberId
+		return res
+	}
+	return c.joinResponse(g, m, res)
+}
+
+func (c *Cluster) joinResponse(g *group, m *member, res *sarama.JoinGroupResponse) *sarama.JoinGroupResponse {
+	res.MemberId = m.id
+	res.LeaderId = g.leader
+	res.GenerationId = g.generation
+	res.GroupProtocol = g.protocol
+	if m.id == g.leader {
+		for _, member := range g.sortedMembers() {
+			gm := sarama.GroupMember{MemberId: member.id, Metadata: protocolMetadata(member.protocols, g.protocol)}
+			if member.instance != "" {
+				gm.GroupInstanceId = &member.instance
+			}
+			res.Members = append(res.Members, gm)
+		}
+	}
+	return res
+}
+
+func (c *Cluster) syncGroup(req *syncGroupRequest, version int16) *sarama.SyncGroupResponse {
+	g := c.groups[req.group]
+	if err := c.memberError(g, req.member, req.generation); err != sarama.ErrNoError {
+		return &sarama.SyncGroupResponse{Version: version, Err: err}
+	}
+	m := g.members[req.member]
+	switch {
+	case g.state == groupPreparing:
+		return &sarama.SyncGroupResponse{Version: version, Err: sarama.ErrRebalanceInProgress}
+	case g.state == groupCompleting && m.id == g.leader:
+		for id, member := range g.members {
+			member.assignment = req.assignments[id]
+			if g.assignment != nil {
+				member.assignment = encodeAssignment(c.t, g.assignment)
+			}
+		}
+		g.assignment = nil
+		g.state = groupStable
+		c.notify()
+	case g.state == groupCompleting:
+		generation := g.generation
+		c.await(0, func() bool {
+			return g.members[m.id] != m || g.generation != generation || g.state != groupCompleting
+		})
+		if err := c.memberError(g, req.member, req.generation); err != sarama.ErrNoError {
+			return &sarama.SyncGroupResponse{Version: version, Err: err}
+		}
+		if g.state != groupStable {
+			return &sarama.SyncGroupResponse{Version: version, Err: sarama.ErrRebalanceInProgress}
+		}
+	}
+	return &sarama.SyncGroupResponse{Version: version, MemberAssignment: m.assignment}
+}
+
+func (c *Cluster) heartbeat(req *heartbeatRequest, version int16) *sarama.HeartbeatResponse {
+	g := c.groups[req.group]
+	if err := c.memberError(g, req.member, req.generation); err != sarama.ErrNoError {
+		return &sarama.HeartbeatResponse{Version: version, Err: err}
+	}
+	g.members[req.member].heartbeat = time.Now()
+	if g.state == groupPreparing {
+		return &sarama.HeartbeatResponse{Version: version, Err: sarama.ErrRebalanceInProgress}
+	}
+	return &sarama.HeartbeatResponse{Version: version}
+}
+
+func (c *Cluster) leaveGroup(req *leaveGroupRequest, version int16) *sarama.LeaveGroupResponse {
+	res := &sarama.LeaveGroupResponse{Version: version}
+	g := c.groups[req.group]
+	for _, id := range req.members {
+		err := sarama.ErrNoError
+		if g == nil || g.members[id] == nil {
+			err = sarama.ErrUnknownMemberId
+		} else {
+			c.removeMember(g, g.members[id])
+		}
+		// v3 answers each member of the batch
+		if version >= 3 {
+			res.Members = append(res.Members, sarama.MemberResponse{MemberId: id, Err: err})
+		} else if err != sarama.ErrNoError {
+			res.Err = err
+		}
+	}
+	return res
+}
+
+// memberError checks that member belongs to generation of g
+func (c *Cluster) memberError(g *group, member string, generation int32) sarama.KError {
+	switch {
+	case g == nil || g.members[member] == nil:
+		return sarama.ErrUnknownMemberId
+	case g.generation != generation:
+		return sarama.ErrIllegalGeneration
+	}
+	return sarama.ErrNoError
+}
+
+// commitError checks that a member can commit the offsets of generation,
+// generation -1 commits outside of the group
+func (c *Cluster) commitError(g *group, member string, generation int32) sarama.KError {
+	if generation < 0 {
+		return sarama.ErrNoError
+	}
+	if err := c.memberError(g, member, generation); err != sarama.ErrNoError {
+		return err
+	}
+	if g.state == groupCompleting {
+		return sarama.ErrRebalanceInProgress
+	}
+	return sarama.ErrNoError
+}
+
+// prepareRebalance makes the members rejoin, the heartbeats fail until
+// they did
+func (c *Cluster) prepareRebalance(g *group) {
+	if len(g.members) == 0 {
+		g.state = groupEmpty
+		c.notify()
+		return
+	}
+	timeout := time.Duration(0)
+	for _, m := range g.members {
+		if m.rebalanceTimeout > timeout {
+			timeout = m.rebalanceTimeout
+		}
+	}
+	g.state = groupPreparing
+	g.deadline = time.Now().Add(timeout)
+	c.notify()
+}
+
+// maybeCompleteJoin starts the next generation once every member joined
+func (c *Cluster) maybeCompleteJoin(g *group) {
+	if g.state != groupPreparing {
+		return
+	}
+	for _, m := range g.members {
+		if !m.pending {
+			return
+		}
+	}
+	if len(g.members) == 0 {
+		g.state = groupEmpty
+		c.notify()
+		return
+	}
+	members := g.sortedMembers()
+	if g.members[g.leader] == nil {
+		g.leader = members[0].id
+	}
+	g.protocol = commonProtocol(g.members[g.leader], members)
+	g.generation++
+	g.state = groupCompleting
+	for _, m := range members {
+		m.pending = false
+		m.assignment = nil
+		m.heartbeat = time.Now()
+	}
+	c.notify()
+}
+
+// removeMember removes m from g and rebalances the others
+func (c *Cluster) removeMember(g *group, m *member) {
+	delete(g.members, m.id)
+	if m.instance != "" && g.instances[m.instance] == m.id {
+		delete(g.instances, m.instance)
+	}
+	if g.state == groupPreparing {
+		c.maybeCompleteJoin(g)
+		c.notify()
+		return
+	}
+	c.prepareRebalance(g)
+}
+
+// replaceMember gives a restarted static member a new id, its previous id is
+// fenced
+func (c *Cluster) replaceMember(g *group, m *member) {
+	delete(g.members, m.id)
+	c.members++
+	if g.leader == m.id {
+		g.leader = fmt.Sprintf("kafkatest-member-%d", c.members)
+	}
+	m.id = fmt.Sprintf("kafkatest-member-%d", c.members)
+	g.members[m.id] = m
+	g.instances[m.instance] = m.id
+	c.notify()
+}
+
+// expire removes the members whose session expired and those that did not
+// rejoin before the rebalance timeout
+func (c *Cluster) expire() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closing:
+			return
+		}
+		c.mu.Lock()
+		now := time.Now()
+		for _, g := range c.groups {
+			for _, m := range g.sortedMembers() {
+				switch {
+				case g.state == groupPreparing && !m.pending && now.After(g.deadline):
+					c.removeMember(g, m)
+				case !m.pending && m.session > 0 && now.Sub(m.heartbeat) > m.session:
+					c.removeMember(g, m)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (g *group) sortedMembers() []*member {
+	members := make([]*member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].seq < members[j].seq })
+	return members
+}
+
+// commonProtocol returns the first protocol of the leader all the members
+// support
+func commonProtocol(leader *member, members []*member) string {
+	for _, p := range leader.protocols {
+		supported := true
+		for _, m := range members {
+			supported = supported && protocolMetadata(m.protocols, p.Name) != nil
+		}
+		if supported {
+			return p.Name
+		}
+	}
+	return leader.protocols[0].Name
+}
+
+func protocolMetadata(protocols []*sarama.GroupProtocol, name string) []byte {
+	for _, p := range protocols {
+		if p.Name == name {
+			if p.Metadata == nil {
+				return []byte{}
+			}
+			return p.Metadata
+		}
+	}
+	return nil
+}
+
+func sameProtocols(a, b []*sarama.GroupProtocol) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !bytes.Equal(a[i].Metadata, b[i].Metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeAssignment encodes the assignment of a member with the mock sync group
+// response of sarama
+func encodeAssignment(t sarama.TestReporter, topics map[string][]int32) []byte {
+	return sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{Topics: topics}).MemberAssignment
+}
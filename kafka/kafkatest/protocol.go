@@ -0,0 +1,462 @@
+package kafkatest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+var errMalformed = errors.New("kafkatest: malformed request")
+
+// api keys of the requests the cluster answers
+const (
+	apiProduce         = 0
+	apiFetch           = 1
+	apiListOffsets     = 2
+	apiMetadata        = 3
+	apiOffsetCommit    = 8
+	apiOffsetFetch     = 9
+	apiFindCoordinator = 10
+	apiJoinGroup       = 11
+	apiHeartbeat       = 12
+	apiLeaveGroup      = 13
+	apiSyncGroup       = 14
+	apiApiVersions     = 18
+	apiInitProducerID  = 22
+)
+
+// api is a request the cluster answers up to maxVersion, name is the sarama
+// type of the request
+type api struct {
+	name       string
+	maxVersion int16
+}
+
+// apis lists the requests the cluster answers, the others time out. The max
+// versions are the ones both decoded below and encoded by sarama, the body
+// of the requests the cluster does not read is not decoded
+var apis = map[int16]api{
+	apiProduce:         {"ProduceRequest", 7},
+	apiFetch:           {"FetchRequest", 11},
+	apiListOffsets:     {"OffsetRequest", 2},
+	apiMetadata:        {"MetadataRequest", 5},
+	apiOffsetCommit:    {"OffsetCommitRequest", 7},
+	apiOffsetFetch:     {"OffsetFetchRequest", 5},
+	apiFindCoordinator: {"FindCoordinatorRequest", 2},
+	apiJoinGroup:       {"JoinGroupRequest", 5},
+	apiHeartbeat:       {"HeartbeatRequest", 3},
+	apiLeaveGroup:      {"LeaveGroupRequest", 3},
+	apiSyncGroup:       {"SyncGroupRequest", 3},
+	apiApiVersions:     {"ApiVersionsRequest", 3},
+	apiInitProducerID:  {"InitProducerIDRequest", 1},
+}
+
+// request is a request frame read from a client, body is one of the request
+// types below or nil when the cluster does not read it
+type request struct {
+	key     int16
+	version int16
+	body    interface{}
+}
+
+type produceRequest struct {
+	acks    int16
+	records map[string]map[int32][]*sarama.ConsumerMessage
+}
+
+type fetchRequest struct {
+	maxWait time.Duration
+	offsets map[string]map[int32]int64
+}
+
+type listOffsetsRequest struct {
+	times map[string]map[int32]int64
+}
+
+type metadataRequest struct {
+	topics     []string
+	all        bool
+	autoCreate bool
+}
+
+type offsetCommitRequest struct {
+	group      string
+	generation int32
+	member     string
+	offsets    map[string]map[int32]int64
+}
+
+// offsetFetchRequest asks for all the committed offsets when partitions is nil
+type offsetFetchRequest struct {
+	group      string
+	partitions map[string][]int32
+}
+
+type joinGroupRequest struct {
+	group            string
+	sessionTimeout   time.Duration
+	rebalanceTimeout time.Duration
+	member           string
+	instance         string
+	protocols        []*sarama.GroupProtocol
+}
+
+type syncGroupRequest struct {
+	group       string
+	generation  int32
+	member      string
+	assignments map[string][]byte
+}
+
+type heartbeatRequest struct {
+	group      string
+	generation int32
+	member     string
+}
+
+type leaveGroupRequest struct {
+	group   string
+	members []string
+}
+
+// decodeRequest decodes a request frame, the size prefix included. Requests
+// the cluster does not answer are returned without body
+func decodeRequest(frame []byte) (*request, error) {
+	d := &decoder{b: frame[4:]}
+	req := &request{key: d.int16(), version: d.int16()}
+	d.int32() // correlation id
+	d.nullableString()
+	if d.err != nil {
+		return nil, d.err
+	}
+	a, ok := apis[req.key]
+	if !ok || req.version > a.maxVersion {
+		return req, nil
+	}
+	switch req.key {
+	case apiProduce:
+		req.body = d.produce(req.version)
+	case apiFetch:
+		req.body = d.fetch(req.version)
+	case apiListOffsets:
+		req.body = d.listOffsets(req.version)
+	case apiMetadata:
+		req.body = d.metadata(req.version)
+	case apiOffsetCommit:
+		req.body = d.offsetCommit(req.version)
+	case apiOffsetFetch:
+		req.body = d.offsetFetch(req.version)
+	case apiJoinGroup:
+		req.body = d.joinGroup(req.version)
+	case apiHeartbeat:
+		req.body = d.heartbeat(req.version)
+	case apiLeaveGroup:
+		req.body = d.leaveGroup(req.version)
+	case apiSyncGroup:
+		req.body = d.syncGroup(req.version)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%s v%d: %w", a.name, req.version, d.err)
+	}
+	return req, nil
+}
+
+func (d *decoder) produce(version int16) *produceRequest {
+	if version >= 3 {
+		d.nullableString() // transactional id
+	}
+	req := &produceRequest{acks: d.int16(), records: make(map[string]map[int32][]*sarama.ConsumerMessage)}
+	d.int32() // timeout
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.string()
+		partitions := make(map[int32][]*sarama.ConsumerMessage)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			msgs, err := decodeRecords(d.bytes())
+			if err != nil && d.err == nil {
+				d.err = err
+			}
+			partitions[partition] = msgs
+		}
+		req.records[topic] = partitions
+	}
+	return req
+}
+
+func (d *decoder) fetch(version int16) *fetchRequest {
+	d.int32() // replica id
+	req := &fetchRequest{maxWait: time.Duration(d.int32()) * time.Millisecond, offsets: make(map[string]map[int32]int64)}
+	d.int32() // min bytes
+	if version >= 3 {
+		d.int32() // max bytes
+	}
+	if version >= 4 {
+		d.int8() // isolation level
+	}
+	if version >= 7 {
+		d.int32() // session id
+		d.int32() // session epoch
+	}
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.string()
+		offsets := make(map[int32]int64)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			if version >= 9 {
+				d.int32() // current leader epoch
+			}
+			offsets[partition] = d.int64()
+			if version >= 5 {
+				d.int64() // log start offset
+			}
+			d.int32() // partition max bytes
+		}
+		req.offsets[topic] = offsets
+	}
+	return req
+}
+
+func (d *decoder) listOffsets(version int16) *listOffsetsRequest {
+	d.int32() // replica id
+	if version >= 2 {
+		d.int8() // isolation level
+	}
+	req := &listOffsetsRequest{times: make(map[string]map[int32]int64)}
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.string()
+		times := make(map[int32]int64)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			if version >= 4 {
+				d.int32() // current leader epoch
+			}
+			times[partition] = d.int64()
+			if version == 0 {
+				d.int32() // max offsets
+			}
+		}
+		req.times[topic] = times
+	}
+	return req
+}
+
+func (d *decoder) metadata(version int16) *metadataRequest {
+	req := &metadataRequest{}
+	n := d.arrayLen()
+	req.all = n < 0 || (n == 0 && version == 0)
+	for i := 0; i < n && d.err == nil; i++ {
+		req.topics = append(req.topics, d.string())
+	}
+	// topics are created on metadata requests before version 4
+	req.autoCreate = version < 4 || d.int8() != 0
+	return req
+}
+
+func (d *decoder) offsetCommit(version int16) *offsetCommitRequest {
+	req := &offsetCommitRequest{group: d.string(), generation: -1, offsets: make(map[string]map[int32]int64)}
+	if version >= 1 {
+		req.generation = d.int32()
+		req.member = d.string()
+	}
+	if version >= 2 && version <= 4 {
+		d.int64() // retention time
+	}
+	if version >= 7 {
+		d.nullableString() // group instance id
+	}
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		topic := d.string()
+		offsets := make(map[int32]int64)
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partition := d.int32()
+			offsets[partition] = d.int64()
+			if version == 1 {
+				d.int64() // commit timestamp
+			}
+			if version >= 6 {
+				d.int32() // leader epoch
+			}
+			d.nullableString() // metadata
+		}
+		req.offsets[topic] = offsets
+	}
+	return req
+}
+
+func (d *decoder) offsetFetch(version int16) *offsetFetchRequest {
+	req := &offsetFetchRequest{group: d.string()}
+	n := d.arrayLen()
+	if n < 0 && version >= 2 {
+		return req
+	}
+	req.partitions = make(map[string][]int32)
+	for i := 0; i < n && d.err == nil; i++ {
+		topic := d.string()
+		partitions := []int32{}
+		for j, m := 0, d.arrayLen(); j < m && d.err == nil; j++ {
+			partitions = append(partitions, d.int32())
+		}
+		req.partitions[topic] = partitions
+	}
+	return req
+}
+
+func (d *decoder) joinGroup(version int16) *joinGroupRequest {
+	req := &joinGroupRequest{group: d.string(), sessionTimeout: time.Duration(d.int32()) * time.Millisecond}
+	req.rebalanceTimeout = req.sessionTimeout
+	if version >= 1 {
+		req.rebalanceTimeout = time.Duration(d.int32()) * time.Millisecond
+	}
+	req.member = d.string()
+	if version >= 5 {
+		req.instance = d.nullableString()
+	}
+	d.string() // protocol type
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		req.protocols = append(req.protocols, &sarama.GroupProtocol{Name: d.string(), Metadata: d.bytes()})
+	}
+	return req
+}
+
+func (d *decoder) syncGroup(version int16) *syncGroupRequest {
+	req := &syncGroupRequest{group: d.string(), generation: d.int32(), member: d.string(), assignments: make(map[string][]byte)}
+	if version >= 3 {
+		d.nullableString() // group instance id
+	}
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		member := d.string()
+		req.assignments[member] = d.bytes()
+	}
+	return req
+}
+
+func (d *decoder) heartbeat(version int16) *heartbeatRequest {
+	req := &heartbeatRequest{group: d.string(), generation: d.int32(), member: d.string()}
+	if version >= 3 {
+		d.nullableString() // group instance id
+	}
+	return req
+}
+
+func (d *decoder) leaveGroup(version int16) *leaveGroupRequest {
+	req := &leaveGroupRequest{group: d.string()}
+	if version < 3 {
+		req.members = []string{d.string()}
+		return req
+	}
+	for i, n := 0, d.arrayLen(); i < n && d.err == nil; i++ {
+		req.members = append(req.members, d.string())
+		d.nullableString() // group instance id
+	}
+	return req
+}
+
+// decoder reads the big endian primitives of the kafka protocol, the first
+// error is kept and the following reads return zero values
+type decoder struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b)-d.off < n {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b[d.off:])
+	if n <= 0 {
+		d.err = errMalformed
+		return 0
+	}
+	d.off += n
+	return v
+}
+
+// arrayLen returns -1 for a null array
+func (d *decoder) arrayLen() int {
+	n := int(d.int32())
+	if n < -1 || n > len(d.b)-d.off {
+		d.err = errMalformed
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+// nullableString returns "" for a null string
+func (d *decoder) nullableString() string {
+	n := int(d.int16())
+	if n == -1 {
+		return ""
+	}
+	return string(d.next(n))
+}
+
+// bytes returns nil for null bytes
+func (d *decoder) bytes() []byte {
+	n := int(d.int32())
+	if n == -1 {
+		return nil
+	}
+	return d.next(n)
+}
+
+// varBytes reads bytes prefixed by a varint length, nil when null
+func (d *decoder) varBytes() []byte {
+	n := int(d.varint())
+	if n == -1 {
+		return nil
+	}
+	return d.next(n)
+}
+
+func (d *decoder) remaining() int {
+	return len(d.b) - d.off
+}
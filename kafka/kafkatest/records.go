@@ -0,0 +1,152 @@
+package kafkatest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/Shopify/sarama"
+	snappy "github.com/eapache/go-xerial-snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+const (
+	compressionMask = 0x07
+	controlBatch    = 0x20
+)
+
+// decodeRecords returns the messages of the record batches or message sets
+// of a produce request, control batches are skipped
+func decodeRecords(b []byte) ([]*sarama.ConsumerMessage, error) {
+	var msgs []*sarama.ConsumerMessage
+	for len(b) > 0 {
+		// the magic byte follows the offset and the size in both formats
+		if len(b) < 17 {
+			return nil, errMalformed
+		}
+		d := &decoder{b: b}
+		d.int64()
+		size := int(d.int32())
+		if size < 0 || size > len(b)-12 {
+			return nil, errMalformed
+		}
+		entry := b[:12+size]
+		b = b[12+size:]
+		var (
+			decoded []*sarama.ConsumerMessage
+			err     error
+		)
+		if entry[16] >= 2 {
+			decoded, err = decodeBatch(entry)
+		} else {
+			decoded, err = decodeMessage(entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, decoded...)
+	}
+	return msgs, nil
+}
+
+func decodeBatch(b []byte) ([]*sarama.ConsumerMessage, error) {
+	d := &decoder{b: b}
+	d.next(17) // offset, size, leader epoch and magic
+	d.int32()  // crc
+	attributes := d.int16()
+	d.int32() // last offset delta
+	first := millis(d.int64())
+	d.int64() // max timestamp
+	d.int64() // producer id
+	d.int16() // producer epoch
+	d.int32() // first sequence
+	n := int(d.int32())
+	if d.err != nil {
+		return nil, d.err
+	}
+	if attributes&controlBatch != 0 {
+		return nil, nil
+	}
+	data, err := decompress(sarama.CompressionCodec(attributes&compressionMask), d.b[d.off:])
+	if err != nil {
+		return nil, err
+	}
+	d = &decoder{b: data}
+	msgs := make([]*sarama.ConsumerMessage, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		d.varint() // length
+		d.int8()   // attributes
+		msg := &sarama.ConsumerMessage{Timestamp: first.Add(time.Duration(d.varint()) * time.Millisecond)}
+		d.varint() // offset delta
+		msg.Key = d.varBytes()
+		msg.Value = d.varBytes()
+		for j, m := 0, int(d.varint()); j < m && d.err == nil; j++ {
+			msg.Headers = append(msg.Headers, &sarama.RecordHeader{Key: d.varBytes(), Value: d.varBytes()})
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, d.err
+}
+
+// decodeMessage decodes a message of the v0 or v1 format, a compressed
+// message wraps a message set
+func decodeMessage(b []byte) ([]*sarama.ConsumerMessage, error) {
+	d := &decoder{b: b}
+	d.next(12) // offset and size
+	d.int32()  // crc
+	magic := d.int8()
+	attributes := d.int8()
+	var timestamp time.Time
+	if magic == 1 {
+		timestamp = millis(d.int64())
+	}
+	key := d.bytes()
+	value := d.bytes()
+	if d.err != nil {
+		return nil, d.err
+	}
+	codec := sarama.CompressionCodec(attributes & compressionMask)
+	if codec == sarama.CompressionNone {
+		return []*sarama.ConsumerMessage{{Key: key, Value: value, Timestamp: timestamp}}, nil
+	}
+	set, err := decompress(codec, value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords(set)
+}
+
+func decompress(codec sarama.CompressionCodec, data []byte) ([]byte, error) {
+	switch codec {
+	case sarama.CompressionNone:
+		return data, nil
+	case sarama.CompressionGZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case sarama.CompressionSnappy:
+		return snappy.Decode(data)
+	case sarama.CompressionLZ4:
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+	case sarama.CompressionZSTD:
+		r, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return r.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("kafkatest: unknown compression codec %d", codec)
+}
+
+func millis(ms int64) time.Time {
+	if ms < 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,174 @@
+package kafka
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/logger"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+var ErrLagVec = errors.New("lag collector must set lag vec")
+
+// LagCollector periodically exports the lag of a consumer group, the
+// difference between the high-water mark and the committed offset of each
+// partition. It reads the offsets committed to kafka, so it works for the
+// groups of Consumer2 and Consumer11
+type LagCollector struct {
+	client   sarama.Client
+	group    string
+	topics   []string
+	interval time.Duration
+	vec      *monitor.KafkaLagVec
+	// committed offsets and when they last moved or the partition caught up,
+	// used for the idle time
+	committed map[topicPartition]int64
+	moved     map[topicPartition]time.Time
+	exit      chan struct{}
+	wg        sync.WaitGroup
+	log       logger.Logi
+}
+
+func NewLagCollector(groupName string, version string, topics []string, brokers []string, vec *monitor.KafkaLagVec,
+	opts ...optFun) (*LagCollector, error) {
+	options := &Options{Name: groupName,
+		topics:  topics,
+		brokers: brokers,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+	err := ValidConsumerOption(options)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.brokers) == 0 {
+		return nil, ErrBrokers
+	}
+	if vec == nil {
+		return nil, ErrLagVec
+	}
+	config := sarama.NewConfig()
+	config.ClientID = groupName + "-lag"
+	config.Version = kafkaVersion(version)
+	if err = configureNet(config, options); err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewClient(options.brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	l := &LagCollector{
+		client:    client,
+		group:     groupName,
+		topics:    topics,
+		interval:  options.lagInterval,
+		vec:       vec,
+		committed: make(map[topicPartition]int64),
+		moved:     make(map[topicPartition]time.Time),
+		exit:      make(chan struct{}),
+		log:       options.log,
+	}
+	if l.interval <= 0 {
+		l.interval = 30 * time.Second
+	}
+	return l, nil
+}
+
+func (l *LagCollector) Start() error {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+		for {
+			if err := l.collect(time.Now()); err != nil && l.log != nil {
+				l.log.Errorf("failed to collect lag of group %s: %s", l.group, err.Error())
+			}
+			select {
+			case <-l.exit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (l *LagCollector) Close() error {
+	close(l.exit)
+	l.wg.Wait()
+	return l.client.Close()
+}
+
+// collect fetches the offsets of all partitions and updates the gauges, a
+// partition failing is skipped until the next round
+func (l *LagCollector) collect(now time.Time) error {
+	partitions := make(map[string][]int32)
+	for _, topic := range l.topics {
+		ps, err := l.client.Partitions(topic)
+		if err != nil {
+			l.skip(topic, -1, err)
+			continue
+		}
+		partitions[topic] = ps
+	}
+	res, err := fetchOffsets(l.client, l.group, partitions)
+	if err != nil {
+		return err
+	}
+	for topic, ps := range partitions {
+		var topicLag int64
+		for _, p := range ps {
+			lag, err := l.lag(res, topic, p)
+			if err != nil {
+				l.skip(topic, p, err)
+				continue
+			}
+			topicLag += lag
+
+			// idle is the time the group has been lagging without committing
+			key := topicPartition{topic: topic, partition: p}
+			committed, _ := committedOffset(res, topic, p)
+			if last, ok := l.committed[key]; !ok || last != committed || lag == 0 {
+				l.committed[key] = committed
+				l.moved[key] = now
+			}
+			labels := &monitor.KafkaLagLabels{Group: l.group, Topic: topic, Partition: p}
+			l.vec.SetLag(labels, float64(lag))
+			l.vec.SetIdle(labels, now.Sub(l.moved[key]).Seconds())
+		}
+		l.vec.SetTopicLag(&monitor.KafkaLagLabels{Group: l.group, Topic: topic}, float64(topicLag))
+	}
+	return nil
+}
+
+// lag returns the messages of the partition not committed by the group
+func (l *LagCollector) lag(res *sarama.OffsetFetchResponse, topic string, partition int32) (int64, error) {
+	offset, err := committedOffset(res, topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	hwm, err := l.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		// nothing committed yet, the whole partition is lag
+		if offset, err = l.client.GetOffset(topic, partition, sarama.OffsetOldest); err != nil {
+			return 0, err
+		}
+	}
+	if lag := hwm - offset; lag > 0 {
+		return lag, nil
+	}
+	return 0, nil
+}
+
+func (l *LagCollector) skip(topic string, partition int32, err error) {
+	if l.log != nil {
+		l.log.Errorf("failed to collect lag of group %s t:%s,p:%d: %s", l.group, topic, partition, err.Error())
+	}
+}
@@ -0,0 +1,82 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+func TestLagCollector(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()).
+			SetLeader("test", 1, broker.BrokerID()).
+			SetLeader("test", 2, broker.BrokerID()).
+			SetLeader("test", 3, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("test", 0, sarama.OffsetNewest, 100).
+			SetOffset("test", 0, sarama.OffsetOldest, 0).
+			SetOffset("test", 1, sarama.OffsetNewest, 50).
+			SetOffset("test", 1, sarama.OffsetOldest, 10).
+			SetOffset("test", 2, sarama.OffsetNewest, 30).
+			SetOffset("test", 2, sarama.OffsetOldest, 0).
+			SetOffset("test", 3, sarama.OffsetNewest, 30).
+			SetOffset("test", 3, sarama.OffsetOldest, 0),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "test-group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("test-group", "test", 0, 40, "", sarama.ErrNoError).
+			SetOffset("test-group", "test", 1, -1, "", sarama.ErrNoError).
+			SetOffset("test-group", "test", 2, 30, "", sarama.ErrNoError).
+			// a failed partition is skipped, the others are still collected
+			SetOffset("test-group", "test", 3, -1, "", sarama.ErrOffsetsLoadInProgress),
+	})
+
+	vec := monitor.NewKafkaLagVec("test", "kafka", "lag")
+	l, err := NewLagCollector("test-group", "2.1.0.0", []string{"test"}, []string{broker.Addr()}, vec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.client.Close()
+
+	now := time.Now()
+	if err = l.collect(now); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.collect(now.Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	p0 := map[string]string{"group": "test-group", "topic": "test", "partition": "0"}
+	p1 := map[string]string{"group": "test-group", "topic": "test", "partition": "1"}
+	p2 := map[string]string{"group": "test-group", "topic": "test", "partition": "2"}
+	lagValue := func(name string, labels map[string]string) float64 {
+		v, ok := metricValue(t, name, labels)
+		if !ok {
+			t.Fatalf("gauge %s %v not found", name, labels)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"lag p0", lagValue("test_kafka_lag", p0), 60},
+		{"lag p1 without commit", lagValue("test_kafka_lag", p1), 40},
+		{"topic lag", lagValue("test_kafka_lag_topic", p0), 100},
+		{"idle p0", lagValue("test_kafka_lag_idle_seconds", p0), 10},
+		{"idle p2 caught up", lagValue("test_kafka_lag_idle_seconds", p2), 0},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+	if _, ok := metricValue(t, "test_kafka_lag", map[string]string{"group": "test-group", "topic": "test", "partition": "3"}); ok {
+		t.Error("lag of the failed partition reported")
+	}
+}
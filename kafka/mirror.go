@@ -0,0 +1,493 @@
+package kafka
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/logger"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+// headers set on mirrored messages, the ones of an earlier mirror are replaced
+const (
+	MirrorHeaderSource    = "x-mirror-source"
+	MirrorHeaderTopic     = "x-mirror-topic"
+	MirrorHeaderPartition = "x-mirror-partition"
+	MirrorHeaderOffset    = "x-mirror-offset"
+)
+
+// mirrorRetryPolicy is the backoff between two sends of a message the
+// destination failed to acknowledge, the mirror never gives up on it
+var mirrorRetryPolicy = RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 10 * time.Second}
+
+// mirrorInflightSize bounds the messages of a claim sent and not acknowledged yet
+const mirrorInflightSize = 256
+
+type mirrorOptions struct {
+	include   *regexp.Regexp
+	exclude   *regexp.Regexp
+	rename    func(topic string) string
+	transform func(msg *sarama.ProducerMessage, src *sarama.ConsumerMessage) (*sarama.ProducerMessage, error)
+	vec       *monitor.KafkaMirrorVec
+	refresh   time.Duration
+}
+
+// Mirror copies topics from a source cluster to a destination cluster. The
+// source offsets are marked once the destination acknowledged the message,
+// a message failing is sent again until it is acknowledged. The messages of a
+// partition are acknowledged in order, the ones sent after a failed message
+// are sent again after it
+type Mirror struct {
+	name      string
+	client    sarama.ConsumerGroup
+	producer  *Producer
+	source    *Options
+	options   *mirrorOptions
+	version   sarama.KafkaVersion
+	mu        sync.Mutex
+	topics    []string
+	cancel    context.CancelFunc
+	rename    func(topic string) string
+	transform func(msg *sarama.ProducerMessage, src *sarama.ConsumerMessage) (*sarama.ProducerMessage, error)
+	vec       *monitor.KafkaMirrorVec
+	exit      chan struct{}
+	wg        sync.WaitGroup
+	log       logger.Logi
+}
+
+// NewMirror creates the mirror name, it is the consumer group of the source
+// and the producer name of the destination. source are the consumer options,
+// the topics of WithTopics are mirrored with the ones matching WithMirrorInclude,
+// they are matched again every WithMirrorRefresh interval. destination are the
+// producer options and opts the WithMirror options
+func NewMirror(name, version string, source, destination []optFun, opts ...optFun) (*Mirror, error) {
+	src := &Options{Name: name}
+	for _, o := range source {
+		o(src)
+	}
+	mo := &mirrorOptions{}
+	for _, o := range opts {
+		o(mo)
+	}
+	v := kafkaVersion(version)
+	topics, err := mirrorTopics(src, mo, v)
+	if err != nil {
+		return nil, err
+	}
+	src.topics = topics
+	if err = ValidConsumerOption(src); err != nil {
+		return nil, err
+	}
+	config, err := newConsumerConfig(src, v)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewConsumerGroup(src.brokers, name, config)
+	if err != nil {
+		return nil, err
+	}
+	if mo.refresh <= 0 {
+		mo.refresh = config.Metadata.RefreshFrequency
+	}
+	producer, err := NewProducerV2(name, version, nil, append(destination, withOrdered())...)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &Mirror{
+		name:      name,
+		client:    client,
+		producer:  producer,
+		source:    src,
+		options:   mo,
+		version:   v,
+		topics:    topics,
+		rename:    mo.rename,
+		transform: mo.transform,
+		vec:       mo.vec,
+		log:       src.log,
+	}, nil
+}
+
+// mirrorTopics returns the source topics sorted, internal topics are only
+// mirrored when given by WithTopics
+func mirrorTopics(src *Options, mo *mirrorOptions, version sarama.KafkaVersion) ([]string, error) {
+	topics := make(map[string]bool)
+	for _, topic := range src.topics {
+		topics[topic] = true
+	}
+	if mo.include != nil && len(src.brokers) > 0 {
+		config := sarama.NewConfig()
+		config.ClientID = src.Name
+		config.Version = version
+		if err := configureNet(config, src); err != nil {
+			return nil, err
+		}
+		client, err := sarama.NewClient(src.brokers, config)
+		if err != nil {
+			return nil, err
+		}
+		all, err := client.Topics()
+		_ = client.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, topic := range all {
+			if !strings.HasPrefix(topic, "__") && mo.include.MatchString(topic) {
+				topics[topic] = true
+			}
+		}
+	}
+	matched := make([]string, 0, len(topics))
+	for topic := range topics {
+		if mo.exclude == nil || !mo.exclude.MatchString(topic) {
+			matched = append(matched, topic)
+		}
+	}
+	sort.Strings(matched)
+	return matched, nil
+}
+
+// Topics returns the source topics being mirrored
+func (m *Mirror) Topics() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.topics...)
+}
+
+// consume joins the source group until it rebalances or the source topics
+// changed
+func (m *Mirror) consume() error {
+	topics, err := m.resolveTopics()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.mu.Lock()
+	m.cancel = cancel
+	// topics resolved meanwhile are joined at once
+	if strings.Join(topics, ",") != strings.Join(m.topics, ",") {
+		cancel()
+	}
+	m.mu.Unlock()
+	return m.client.Consume(ctx, topics, m)
+}
+
+// resolveTopics matches the source topics against WithMirrorInclude again,
+// the source group is rejoined when they changed
+func (m *Mirror) resolveTopics() ([]string, error) {
+	if m.options.include == nil {
+		return m.Topics(), nil
+	}
+	topics, err := mirrorTopics(m.source, m.options, m.version)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.Join(topics, ",") != strings.Join(m.topics, ",") {
+		if m.log != nil {
+			m.log.Infof("mirror %s topics %v", m.name, topics)
+		}
+		if m.cancel != nil {
+			m.cancel()
+		}
+	}
+	m.topics = topics
+	return topics, nil
+}
+
+// refreshTopics resolves the source topics every WithMirrorRefresh interval
+func (m *Mirror) refreshTopics() {
+	defer m.wg.Done()
+	t := time.NewTicker(m.options.refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.exit:
+			return
+		case <-t.C:
+		}
+		if _, err := m.resolveTopics(); err != nil && m.log != nil {
+			m.log.Errorf("mirror %s failed to list the source topics: %s", m.name, err.Error())
+		}
+	}
+}
+
+func (m *Mirror) Start() error {
+	if m.log != nil {
+		m.log.Infof("mirror %s topics %v", m.name, m.Topics())
+	}
+	m.producer.Start()
+	m.exit = make(chan struct{})
+	m.wg.Add(2)
+	if m.options.include != nil {
+		m.wg.Add(1)
+		go m.refreshTopics()
+	}
+	go func() {
+		defer m.wg.Done()
+		for failures := 0; ; {
+			select {
+			case <-m.exit:
+				return
+			default:
+			}
+			err := m.consume()
+			if err == nil {
+				failures = 0
+				continue
+			}
+			failures++
+			if m.log != nil {
+				m.log.Errorf(err.Error())
+			}
+			// a failure coming back at once must not spin
+			t := time.NewTimer(mirrorRetryPolicy.backoff(failures))
+			select {
+			case <-m.exit:
+				t.Stop()
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	go m.doErrors()
+	return nil
+}
+
+// Close leaves the source group once the messages in flight are acknowledged
+// and their offsets committed, then shuts the destination producer down
+func (m *Mirror) Close() error {
+	close(m.exit)
+	err := m.client.Close()
+	m.wg.Wait()
+	m.producer.Close()
+	return err
+}
+
+func (m *Mirror) doErrors() {
+	defer m.wg.Done()
+	for err := range m.client.Errors() {
+		if err != nil && m.log != nil {
+			m.log.Errorf("receive kafka mirror %s error: %s", m.name, err.Error())
+		}
+	}
+}
+
+func (m *Mirror) Setup(sarama.ConsumerGroupSession) error { return nil }
+
+func (m *Mirror) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+// mirrored is a source message and the delivery report of its copy, report is
+// nil when the message is not copied
+type mirrored struct {
+	msg    *sarama.ConsumerMessage
+	out    *sarama.ProducerMessage
+	report <-chan *DeliveryReport
+}
+
+// mirrorGate holds the sends of a claim back while the messages sent already
+// are sent again in order
+type mirrorGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	sent   int
+}
+
+func newMirrorGate() *mirrorGate {
+	g := &mirrorGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// send calls send once the gate is open
+func (g *mirrorGate) send(send func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.cond.Wait()
+	}
+	send()
+	g.sent++
+}
+
+// pause holds the sends back and returns the number of sends so far
+func (g *mirrorGate) pause() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+	return g.sent
+}
+
+func (g *mirrorGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = false
+	g.cond.Broadcast()
+}
+
+// ConsumeClaim sends the claim messages to the destination, the acknowledgements
+// are waited for in order so the offsets are marked in order too
+func (m *Mirror) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	pending := make(chan *mirrored, mirrorInflightSize)
+	gate := newMirrorGate()
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		m.acks(session, claim, pending, gate)
+	}()
+	for msg := range claim.Messages() {
+		f := &mirrored{msg: msg}
+		out, err := m.message(msg)
+		switch {
+		case err != nil:
+			m.inc(msg.Topic, "transformerror")
+			if m.log != nil {
+				m.log.Errorf("mirror %s skips message t:%s,p:%d,o:%d: %s", m.name, msg.Topic, msg.Partition, msg.Offset, err.Error())
+			}
+		case out == nil:
+			m.inc(msg.Topic, "filtered")
+		default:
+			f.out = out
+			gate.send(func() {
+				f.report = m.producer.SendAsync(session.Context(), out)
+			})
+		}
+		pending <- f
+	}
+	close(pending)
+	<-acked
+	return nil
+}
+
+// acks marks the offset of every message acknowledged by the destination, it
+// stops marking once a message could not be acknowledged before the session
+// ended. After a failed message the sends are held back until it and the ones
+// sent after it are acknowledged again one by one, so the destination ends up
+// with the messages of the partition in order
+func (m *Mirror) acks(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim, pending <-chan *mirrored, gate *mirrorGate) {
+	failed := false
+	acked, held := 0, 0
+	for f := range pending {
+		if failed {
+			continue
+		}
+		if f.report != nil {
+			acked++
+			if !m.ack(session, f, acked <= held, func() { held = gate.pause() }) {
+				failed = true
+				gate.resume()
+				continue
+			}
+			if acked == held {
+				gate.resume()
+			}
+		}
+		session.MarkOffset(f.msg.Topic, f.msg.Partition, f.msg.Offset+1, "")
+		if m.vec != nil {
+			m.vec.SetLag(&monitor.KafkaMirrorLabels{Mirror: m.name, Topic: f.msg.Topic, Partition: f.msg.Partition},
+				float64(claim.HighWaterMarkOffset()-f.msg.Offset-1))
+		}
+	}
+}
+
+// ack waits for the delivery report of f and sends it again until it succeeds,
+// it returns false when the session ended first. held is set when f was sent
+// before a failed message, it is sent again even when it succeeded. Otherwise
+// pause is called on its first failure to hold the next sends back
+func (m *Mirror) ack(session sarama.ConsumerGroupSession, f *mirrored, held bool, pause func()) bool {
+	resend := held
+	for attempts := 0; ; {
+		var r *DeliveryReport
+		select {
+		case r = <-f.report:
+		case <-session.Context().Done():
+			return false
+		}
+		if r.Err == nil && !resend {
+			m.inc(f.msg.Topic, "ok")
+			return true
+		}
+		if r.Err != nil {
+			attempts++
+			m.inc(f.msg.Topic, "error")
+			if m.log != nil {
+				m.log.Warnf("mirror %s failed to send t:%s,p:%d,o:%d attempt %d: %s", m.name, f.msg.Topic, f.msg.Partition, f.msg.Offset, attempts, r.Err.Error())
+			}
+			if !held {
+				pause()
+				held = true
+			}
+			t := time.NewTimer(mirrorRetryPolicy.backoff(attempts))
+			select {
+			case <-t.C:
+			case <-session.Context().Done():
+				t.Stop()
+				return false
+			}
+		}
+		// the sends are held back, the copy is acknowledged in order
+		resend = false
+		f.report = m.producer.SendAsync(session.Context(), copyProducerMessage(f.out))
+	}
+}
+
+// message returns the copy of msg to send, nil when the transformation drops it
+func (m *Mirror) message(msg *sarama.ConsumerMessage) (*sarama.ProducerMessage, error) {
+	topic := msg.Topic
+	if m.rename != nil {
+		topic = m.rename(topic)
+	}
+	pm := &sarama.ProducerMessage{
+		Topic:     topic,
+		Value:     sarama.ByteEncoder(msg.Value),
+		Timestamp: msg.Timestamp,
+		Headers:   make([]sarama.RecordHeader, 0, len(msg.Headers)+4),
+	}
+	if msg.Key != nil {
+		pm.Key = sarama.ByteEncoder(msg.Key)
+	}
+	for _, rh := range msg.Headers {
+		if rh != nil && !strings.HasPrefix(string(rh.Key), "x-mirror-") {
+			pm.Headers = append(pm.Headers, *rh)
+		}
+	}
+	pm.Headers = append(pm.Headers,
+		sarama.RecordHeader{Key: []byte(MirrorHeaderSource), Value: []byte(m.name)},
+		sarama.RecordHeader{Key: []byte(MirrorHeaderTopic), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte(MirrorHeaderPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte(MirrorHeaderOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+	)
+	if m.transform != nil {
+		return m.transform(pm, msg)
+	}
+	return pm, nil
+}
+
+// copyProducerMessage returns a message to send again, sarama keeps the
+// retry state of a message in it
+func copyProducerMessage(msg *sarama.ProducerMessage) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic:     msg.Topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   msg.Headers,
+		Metadata:  msg.Metadata,
+		Timestamp: msg.Timestamp,
+	}
+}
+
+func (m *Mirror) inc(topic, status string) {
+	if m.vec != nil {
+		m.vec.Inc(&monitor.KafkaMirrorLabels{Mirror: m.name, Topic: topic, Status: status})
+	}
+}
@@ -0,0 +1,159 @@
+package kafka
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/kafka/kafkatest"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+func header(msg *sarama.ConsumerMessage, key string) string {
+	for _, h := range msg.Headers {
+		if string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func TestMirror(t *testing.T) {
+	source := kafkatest.NewCluster(t)
+	defer source.Close()
+	destination := kafkatest.NewCluster(t)
+	defer destination.Close()
+	source.Produce("orders", 0, []byte("k"), []byte("a"))
+	source.Produce("orders", 0, nil, []byte("drop"))
+	source.Produce("orders", 0, nil, []byte("b"))
+	source.Produce("audit", 0, nil, []byte("x"))
+	source.Produce("logs", 0, nil, []byte("l"))
+
+	m, err := NewMirror("test-mirror", "2.1.0.0",
+		[]optFun{WithBrokers(source.Addrs()), WithFromOldest(true)},
+		[]optFun{WithBrokers(destination.Addrs()), WithQueueSize(10)},
+		WithMirrorInclude(regexp.MustCompile(`^(orders|audit|logs)(\.v[0-9])?$`)),
+		WithMirrorExclude(regexp.MustCompile(`^logs$`)),
+		WithMirrorRename(func(topic string) string { return "mirror." + topic }),
+		WithMirrorTransform(func(msg *sarama.ProducerMessage, src *sarama.ConsumerMessage) (*sarama.ProducerMessage, error) {
+			if string(src.Value) == "drop" {
+				return nil, nil
+			}
+			return msg, nil
+		}),
+		WithMirrorVec(monitor.NewKafkaMirrorVec("test", "kafka", "mirror")),
+		WithMirrorRefresh(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := m.Topics(); len(topics) != 2 || topics[0] != "audit" || topics[1] != "orders" {
+		t.Fatalf("topics %v", topics)
+	}
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	msgs := destination.WaitMessages("mirror.orders", 2, 10*time.Second)
+	if len(msgs) != 2 || string(msgs[0].Value) != "a" || string(msgs[0].Key) != "k" || string(msgs[1].Value) != "b" {
+		t.Fatalf("mirrored %v", msgs)
+	}
+	if header(msgs[1], MirrorHeaderSource) != "test-mirror" || header(msgs[1], MirrorHeaderTopic) != "orders" ||
+		header(msgs[1], MirrorHeaderPartition) != "0" || header(msgs[1], MirrorHeaderOffset) != "2" {
+		t.Errorf("provenance headers %v", msgs[1].Headers)
+	}
+	if msgs = destination.WaitMessages("mirror.audit", 1, 10*time.Second); len(msgs) != 1 {
+		t.Errorf("mirrored audit %v", msgs)
+	}
+	if !source.WaitCommitted("test-mirror", "orders", 0, 3, 10*time.Second) {
+		t.Fatalf("source offset %d", source.Committed("test-mirror", "orders", 0))
+	}
+
+	// the source offset is committed once the destination acknowledged
+	destination.SetProduceError("mirror.orders", 0, sarama.ErrBrokerNotAvailable)
+	source.Produce("orders", 0, nil, []byte("c"))
+	time.Sleep(1500 * time.Millisecond)
+	if offset := source.Committed("test-mirror", "orders", 0); offset != 3 {
+		t.Errorf("offset %d committed before the destination acknowledged", offset)
+	}
+	destination.SetProduceError("mirror.orders", 0, sarama.ErrNoError)
+	if msgs = destination.WaitMessages("mirror.orders", 3, 10*time.Second); len(msgs) != 3 || string(msgs[2].Value) != "c" {
+		t.Fatalf("mirrored after the destination recovered %v", msgs)
+	}
+	if !source.WaitCommitted("test-mirror", "orders", 0, 4, 10*time.Second) {
+		t.Errorf("source offset %d", source.Committed("test-mirror", "orders", 0))
+	}
+
+	// a topic created later is mirrored once the source group rejoined
+	source.Produce("audit.v2", 0, nil, []byte("y"))
+	if msgs = destination.WaitMessages("mirror.audit.v2", 1, 10*time.Second); len(msgs) != 1 || string(msgs[0].Value) != "y" {
+		t.Errorf("mirrored audit.v2 %v", msgs)
+	}
+	if topics := m.Topics(); len(topics) != 3 || topics[1] != "audit.v2" {
+		t.Errorf("topics %v", topics)
+	}
+}
+
+type mirrorSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	mu     sync.Mutex
+	marked []int64
+}
+
+func (s *mirrorSession) Context() context.Context { return s.ctx }
+
+func (s *mirrorSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, offset)
+}
+
+type mirrorClaim struct {
+	sarama.ConsumerGroupClaim
+	msgs chan *sarama.ConsumerMessage
+}
+
+func (c *mirrorClaim) Messages() <-chan *sarama.ConsumerMessage { return c.msgs }
+func (c *mirrorClaim) HighWaterMarkOffset() int64               { return 10 }
+
+func TestMirrorFailedCopyOrder(t *testing.T) {
+	backoff := mirrorRetryPolicy
+	mirrorRetryPolicy = RetryPolicy{InitialBackoff: time.Millisecond}
+	defer func() { mirrorRetryPolicy = backoff }()
+	rp := newRecordProducer(1)
+	m := &Mirror{name: "test-mirror", producer: newMockProducer(t, rp)}
+	defer m.producer.Close()
+	session := &mirrorSession{ctx: context.Background()}
+	claim := &mirrorClaim{msgs: make(chan *sarama.ConsumerMessage, 10)}
+	for i := int64(0); i < 10; i++ {
+		claim.msgs <- &sarama.ConsumerMessage{Topic: "orders", Offset: i, Key: []byte("k"), Value: []byte(strconv.FormatInt(i, 10))}
+	}
+	close(claim.msgs)
+	if err := m.ConsumeClaim(session, claim); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first copy failed, the last copy of every message is in order
+	last := map[string]int{}
+	sent := rp.messages()
+	for i, msg := range sent {
+		for _, h := range msg.Headers {
+			if string(h.Key) == MirrorHeaderOffset {
+				last[string(h.Value)] = i
+			}
+		}
+	}
+	for i := 1; i < 10; i++ {
+		if last[strconv.Itoa(i)] < last[strconv.Itoa(i-1)] {
+			t.Fatalf("offset %d copied before %d: %d messages", i, i-1, len(sent))
+		}
+	}
+	if len(session.marked) != 10 || session.marked[9] != 10 {
+		t.Errorf("marked offsets %v", session.marked)
+	}
+}
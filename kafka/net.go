@@ -0,0 +1,48 @@
+package kafka
+
+import (
+	"context"
+	"net"
+
+	"github.com/Shopify/sarama"
+)
+
+// configureNet applies the SASL and TLS options shared by consumers and producers
+func configureNet(c *sarama.Config, o *Options) error {
+	if err := configureSASL(c, o); err != nil {
+		return err
+	}
+	if o.tls.enable {
+		tc, err := newTLSClient(&o.tls)
+		if err != nil {
+			return err
+		}
+		if tc.reloader != nil {
+			// the broker host is only known when dialing, the connection is
+			// wrapped in tls by the dialer instead of sarama
+			c.Net.Proxy.Enable = true
+			c.Net.Proxy.Dialer = &tlsDialer{config: c, tls: tc}
+			return nil
+		}
+		c.Net.TLS.Enable = true
+		c.Net.TLS.Config = tc.config
+	}
+	return nil
+}
+
+// tlsDialer opens the broker tls connections with the sarama net settings
+type tlsDialer struct {
+	config *sarama.Config
+	tls    *tlsClient
+}
+
+func (d *tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   d.config.Net.DialTimeout,
+		KeepAlive: d.config.Net.KeepAlive,
+		LocalAddr: d.config.Net.LocalAddr,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.config.Net.DialTimeout)
+	defer cancel()
+	return d.tls.dial(ctx, dialer, network, addr)
+}
@@ -0,0 +1,43 @@
+package kafka
+
+import "sync"
+
+// offsetTracker follows the messages of one partition completing out of order
+// and reports the offset up to which every dispatched message is done
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending []int64
+	done    map[int64]struct{}
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{done: make(map[int64]struct{})}
+}
+
+// add registers offset as dispatched, offsets must be added in order
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	t.pending = append(t.pending, offset)
+	t.mu.Unlock()
+}
+
+// complete marks offset as done. When the lowest pending offsets are all done
+// it calls commit with the next offset to consume, commit runs under the
+// tracker lock so committed offsets never go backwards
+func (t *offsetTracker) complete(offset int64, commit func(next int64)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[offset] = struct{}{}
+	next := int64(-1)
+	for len(t.pending) > 0 {
+		if _, ok := t.done[t.pending[0]]; !ok {
+			break
+		}
+		delete(t.done, t.pending[0])
+		next = t.pending[0] + 1
+		t.pending = t.pending[1:]
+	}
+	if next >= 0 {
+		commit(next)
+	}
+}
@@ -0,0 +1,30 @@
+package kafka
+
+import "testing"
+
+func TestOffsetTracker(t *testing.T) {
+	tracker := newOffsetTracker()
+	for _, o := range []int64{3, 4, 7, 8} {
+		tracker.add(o)
+	}
+	committed := int64(-1)
+	commit := func(next int64) {
+		committed = next
+	}
+	tracker.complete(4, commit)
+	if committed != -1 {
+		t.Errorf("committed %d before offset 3 is done", committed)
+	}
+	tracker.complete(3, commit)
+	if committed != 5 {
+		t.Errorf("committed %d, want 5", committed)
+	}
+	tracker.complete(8, commit)
+	if committed != 5 {
+		t.Errorf("committed %d, want 5", committed)
+	}
+	tracker.complete(7, commit)
+	if committed != 9 {
+		t.Errorf("committed %d, want 9", committed)
+	}
+}
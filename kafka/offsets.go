@@ -0,0 +1,215 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// OffsetSpec is the position a consumer group is reset to
+type OffsetSpec struct {
+	offset int64
+	time   time.Time
+}
+
+// ResetToEarliest is the oldest offset still in the partition
+func ResetToEarliest() OffsetSpec {
+	return OffsetSpec{offset: sarama.OffsetOldest}
+}
+
+// ResetToLatest is the high-water mark, nothing is replayed
+func ResetToLatest() OffsetSpec {
+	return OffsetSpec{offset: sarama.OffsetNewest}
+}
+
+// ResetToOffset is offset, limited to the offsets in the partition
+func ResetToOffset(offset int64) OffsetSpec {
+	return OffsetSpec{offset: offset}
+}
+
+// ResetToTime is the first offset whose timestamp is at or after t, or the
+// high-water mark when there is none
+func ResetToTime(t time.Time) OffsetSpec {
+	return OffsetSpec{time: t}
+}
+
+func (s OffsetSpec) String() string {
+	switch {
+	case !s.time.IsZero():
+		return s.time.Format(time.RFC3339)
+	case s.offset == sarama.OffsetOldest:
+		return "earliest"
+	case s.offset == sarama.OffsetNewest:
+		return "latest"
+	}
+	return fmt.Sprintf("offset %d", s.offset)
+}
+
+// OffsetChange is the planned or applied move of a partition of a group,
+// Current is -1 if the group has not committed the partition yet
+type OffsetChange struct {
+	Group     string
+	Topic     string
+	Partition int32
+	Current   int64
+	Target    int64
+}
+
+func (c *OffsetChange) String() string {
+	return fmt.Sprintf("group %s topic %s partition %d: %d -> %d", c.Group, c.Topic, c.Partition, c.Current, c.Target)
+}
+
+// resolveOffset returns the offset spec points to in a partition
+func resolveOffset(client sarama.Client, topic string, partition int32, spec OffsetSpec) (int64, error) {
+	if !spec.time.IsZero() {
+		offset, err := client.GetOffset(topic, partition, spec.time.UnixNano()/int64(time.Millisecond))
+		if err != nil || offset >= 0 {
+			return offset, err
+		}
+		return client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	if spec.offset == sarama.OffsetOldest || spec.offset == sarama.OffsetNewest {
+		return client.GetOffset(topic, partition, spec.offset)
+	}
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return -1, err
+	}
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return -1, err
+	}
+	switch {
+	case spec.offset < oldest:
+		return oldest, nil
+	case spec.offset > newest:
+		return newest, nil
+	}
+	return spec.offset, nil
+}
+
+// fetchCommitted returns the offsets committed by group, -1 for the
+// partitions without commit
+func fetchCommitted(client sarama.Client, group string, partitions map[string][]int32) (map[topicPartition]int64, error) {
+	res, err := fetchOffsets(client, group, partitions)
+	if err != nil {
+		return nil, err
+	}
+	committed := make(map[topicPartition]int64)
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			offset, err := committedOffset(res, topic, p)
+			if err != nil {
+				return nil, err
+			}
+			committed[topicPartition{topic: topic, partition: p}] = offset
+		}
+	}
+	return committed, nil
+}
+
+// fetchOffsets asks the coordinator of group for the offsets committed on partitions
+func fetchOffsets(client sarama.Client, group string, partitions map[string][]int32) (*sarama.OffsetFetchResponse, error) {
+	req := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	for topic, ps := range partitions {
+		for _, p := range ps {
+			req.AddPartition(topic, p)
+		}
+	}
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	res, err := coordinator.FetchOffset(req)
+	if err != nil {
+		_ = client.RefreshCoordinator(group)
+		return nil, err
+	}
+	return res, nil
+}
+
+// committedOffset returns the offset of the partition in res, -1 without commit
+func committedOffset(res *sarama.OffsetFetchResponse, topic string, partition int32) (int64, error) {
+	block := res.GetBlock(topic, partition)
+	if block == nil {
+		return -1, nil
+	}
+	if block.Err != sarama.ErrNoError {
+		return -1, block.Err
+	}
+	return block.Offset, nil
+}
+
+// commitOffsets commits offsets for group from outside the group, kafka
+// rejects it while the group has members
+func commitOffsets(client sarama.Client, group string, offsets map[topicPartition]int64) error {
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: -1,
+		RetentionTime:           -1,
+	}
+	for tp, offset := range offsets {
+		req.AddBlock(tp.topic, tp.partition, offset, -1, 0, "")
+	}
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return err
+	}
+	res, err := coordinator.CommitOffset(req)
+	if err != nil {
+		_ = client.RefreshCoordinator(group)
+		return err
+	}
+	for _, errs := range res.Errors {
+		for _, kerr := range errs {
+			if kerr != sarama.ErrNoError {
+				return kerr
+			}
+		}
+	}
+	return nil
+}
+
+// seedStartOffsets commits the offsets at the start time for the partitions
+// the group has not committed yet, so a new group starts from there
+func seedStartOffsets(options *Options, config *sarama.Config) error {
+	client, err := sarama.NewClient(options.brokers, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	partitions := make(map[string][]int32)
+	for _, topic := range options.topics {
+		if partitions[topic], err = client.Partitions(topic); err != nil {
+			return err
+		}
+	}
+	committed, err := fetchCommitted(client, options.Name, partitions)
+	if err != nil {
+		return err
+	}
+	seed := make(map[topicPartition]int64)
+	for tp, offset := range committed {
+		if offset >= 0 {
+			continue
+		}
+		if seed[tp], err = resolveOffset(client, tp.topic, tp.partition, ResetToTime(options.startTime)); err != nil {
+			return err
+		}
+	}
+	if len(seed) == 0 {
+		return nil
+	}
+	err = commitOffsets(client, options.Name, seed)
+	switch err {
+	case sarama.ErrUnknownMemberId, sarama.ErrIllegalGeneration, sarama.ErrRebalanceInProgress:
+		// the group is running, its members own the offsets
+		if options.log != nil {
+			options.log.Warnf("group %s is active, start time ignored", options.Name)
+		}
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// eventsTime is the timestamp in ms the mock brokers know offsets for
+const eventsTime int64 = 1600000000000
+
+func commitRequests(broker *sarama.MockBroker) int {
+	return countRequests(broker, func(req interface{}) bool {
+		_, ok := req.(*sarama.OffsetCommitRequest)
+		return ok
+	})
+}
+
+func TestAdminResetGroupOffsets(t *testing.T) {
+	admin, broker := newMockAdmin(t)
+	defer broker.Close()
+	defer admin.Close()
+
+	at := time.Unix(0, eventsTime*int64(time.Millisecond))
+	for _, tc := range []struct {
+		spec OffsetSpec
+		want []int64
+	}{
+		{ResetToEarliest(), []int64{10, 0}},
+		{ResetToLatest(), []int64{100, 50}},
+		{ResetToOffset(20), []int64{20, 20}},
+		{ResetToOffset(80), []int64{80, 50}},
+		{ResetToOffset(5), []int64{10, 5}},
+		// partition 1 has no message after the time
+		{ResetToTime(at), []int64{70, 50}},
+	} {
+		changes, err := admin.ResetGroupOffsets("idle-group", "events", nil, tc.spec, true)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		if len(changes) != 2 || changes[0].Current != 90 || changes[1].Current != -1 {
+			t.Fatalf("%s: changes %v", tc.spec, changes)
+		}
+		for i, c := range changes {
+			if c.Partition != int32(i) || c.Target != tc.want[i] {
+				t.Errorf("%s: %s, want target %d", tc.spec, c, tc.want[i])
+			}
+		}
+	}
+	if n := commitRequests(broker); n != 0 {
+		t.Errorf("dry run committed %d times", n)
+	}
+
+	changes, err := admin.ResetGroupOffsets("idle-group", "events", []int32{1}, ResetToEarliest(), false)
+	if err != nil || len(changes) != 1 || changes[0].Target != 0 {
+		t.Fatalf("changes %v err %v", changes, err)
+	}
+	if n := commitRequests(broker); n != 1 {
+		t.Errorf("reset committed %d times", n)
+	}
+
+	if _, err = admin.ResetGroupOffsets("test-group", "events", nil, ResetToEarliest(), true); !errors.Is(err, ErrGroupActive) {
+		t.Errorf("active group err %v", err)
+	}
+}
+
+func TestSeedStartOffsets(t *testing.T) {
+	admin, broker := newMockAdmin(t)
+	defer broker.Close()
+	defer admin.Close()
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_1_0_0
+	options := &Options{Name: "idle-group", topics: []string{"events"}, brokers: []string{broker.Addr()}}
+	WithStartTime(time.Unix(0, eventsTime*int64(time.Millisecond)))(options)
+	if err := seedStartOffsets(options, config); err != nil {
+		t.Fatal(err)
+	}
+	if n := commitRequests(broker); n != 1 {
+		t.Errorf("seed committed %d times", n)
+	}
+
+	// the members of an active group own the offsets
+	options.Name = "test-group"
+	if err := seedStartOffsets(options, config); err != nil {
+		t.Errorf("active group err %v", err)
+	}
+}
@@ -2,6 +2,10 @@ package kafka
 
 import (
 	"errors"
+	"regexp"
+	"time"
+
+	"github.com/Shopify/sarama"
 	"github.com/jinglov/gomisc/logger"
 	"github.com/jinglov/gomisc/monitor"
 )
@@ -9,19 +13,49 @@ import (
 type optFun func(interface{})
 
 type Options struct {
-	Name        string
-	topics      []string
-	brokers     []string
-	resetOffset bool
-	fromOldest  bool
-	user        string
-	password    string
-	vec         *monitor.KafkaVec
-	version     string
-	numWorkers  int
-	queueSize   int
-	cachePath   string
-	log         logger.Logi
+	Name           string
+	topics         []string
+	brokers        []string
+	resetOffset    bool
+	fromOldest     bool
+	user           string
+	password       string
+	vec            *monitor.KafkaVec
+	version        string
+	numWorkers     int
+	queueSize      int
+	cachePath      string
+	zookeepers     []string
+	dlqTopic       string
+	dlqProducer    *Producer
+	retry          *RetryPolicy
+	strict         bool
+	batchSize      int
+	batchLinger    time.Duration
+	batchVec       *monitor.KafkaBatchVec
+	claimWorkers   int
+	overflowPolicy OverflowPolicy
+	blockTimeout   time.Duration
+	idempotent     bool
+	ordered        bool
+	txnTimeout     time.Duration
+	readCommitted  bool
+	tls            tlsOptions
+	saslMechanism  string
+	tokenProvider  sarama.AccessTokenProvider
+	tuning         producerTuning
+	group          groupTuning
+	partitioner    sarama.PartitionerConstructor
+	lagInterval    time.Duration
+	startTime      time.Time
+	pausedVec      *monitor.KafkaPausedVec
+	onAssigned     func(map[string][]int32)
+	onRevoked      func(map[string][]int32)
+	decodeError    func(*sarama.ConsumerMessage, error) error
+	secondary      []string
+	failover       failoverOptions
+	clusterVec     *monitor.KafkaClusterVec
+	log            logger.Logi
 }
 
 // producer is name
@@ -115,6 +149,509 @@ func WithCachePath(cachePath string) optFun {
 	}
 }
 
+// consumer 0.8 zookeepers
+func WithZookeepers(zookeepers []string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.zookeepers = zookeepers
+		}
+	}
+}
+
+// consumer 0.8 reset offsets
+func WithResetOffset(resetOffset bool) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.resetOffset = resetOffset
+		}
+	}
+}
+
+// consumer dead-letter topic, messages failed to process are republished
+// to topic by producer instead of being dropped. Their offset is marked once
+// the broker acknowledged the dead-letter message, a failed publish is sent
+// again until then. Publish errors that cannot succeed, like a message too
+// large or a topic authorization failure, drop the message unless strict
+func WithDeadLetter(topic string, producer *Producer) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.dlqTopic = topic
+			o.dlqProducer = producer
+		}
+	}
+}
+
+// consumer retry policy applied before a failed message is given up
+func WithRetryPolicy(policy RetryPolicy) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.retry = &policy
+		}
+	}
+}
+
+// consumer at-least-once mode, a message failed to process keeps being retried
+// and its offset is not marked until it succeeds or was sent to the
+// dead-letter topic, a failed dead-letter publish is retried the same way.
+// Errors the retry policy does not retry, Permanent ones by default, are
+// dead-lettered or dropped.
+// Consumer2 blocks only the claim of the failed partition, Consumer11 blocks
+// every partition since it consumes them on one goroutine
+func WithStrictCommit(strict bool) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.strict = strict
+		}
+	}
+}
+
+// batch consumer flushes once batchSize messages are collected
+func WithBatchSize(batchSize int) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok && batchSize > 0 {
+			o.batchSize = batchSize
+		}
+	}
+}
+
+// batch consumer flushes once the oldest message waited for linger
+func WithBatchLinger(linger time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok && linger > 0 {
+			o.batchLinger = linger
+		}
+	}
+}
+
+// batch consumer prometheus vec of batch size and flush latency
+func WithBatchVec(vec *monitor.KafkaBatchVec) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.batchVec = vec
+		}
+	}
+}
+
+// consumer workers per partition claim, messages are dispatched by key hash
+// so messages with the same key are still processed in order. The process
+// function is called concurrently for different keys and must be goroutine-safe.
+// Only Consumer2 supports it
+func WithClaimWorkers(workers int) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok && workers > 0 {
+			o.claimWorkers = workers
+		}
+	}
+}
+
+// producer behaviour when its queue is full, default is OverflowSpill
+func WithOverflowPolicy(policy OverflowPolicy) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.overflowPolicy = policy
+		}
+	}
+}
+
+// producer OverflowBlock deadline of the sends without context, 0 waits forever
+func WithBlockTimeout(timeout time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.blockTimeout = timeout
+		}
+	}
+}
+
+// producer idempotent writes, requires kafka version >= 0.11
+func WithIdempotent(idempotent bool) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.idempotent = idempotent
+		}
+	}
+}
+
+// producer partitioner, NewMurmur2Partitioner matches the Java client,
+// default is sarama.NewHashPartitioner
+func WithPartitioner(partitioner sarama.PartitionerConstructor) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.partitioner = partitioner
+		}
+	}
+}
+
+// producer compression codec, default is snappy
+func WithCompression(codec sarama.CompressionCodec) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tuning.compression = &codec
+		}
+	}
+}
+
+// producer compression level of gzip, lz4 and zstd
+func WithCompressionLevel(level int) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tuning.compressionLevel = &level
+		}
+	}
+}
+
+// withOrdered keeps the messages of a partition in order through the retries of
+// the producer, with a single worker and request in flight per broker
+func withOrdered() optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.ordered = true
+		}
+	}
+}
+
+// producer acks required from the brokers, idempotent writes require sarama.WaitForAll
+func WithRequiredAcks(acks sarama.RequiredAcks) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tuning.requiredAcks = &acks
+		}
+	}
+}
+
+// producer flushes a batch once any of frequency, bytes or messages is reached,
+// maxMessages caps the messages of one request
+func WithFlush(frequency time.Duration, bytes, messages, maxMessages int) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tuning.flushFrequency = frequency
+			o.tuning.flushBytes = bytes
+			o.tuning.flushMessages = messages
+			o.tuning.flushMaxMessages = maxMessages
+		}
+	}
+}
+
+// producer max size of a message, should not exceed the broker message.max.bytes
+func WithMaxMessageBytes(bytes int) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tuning.maxMessageBytes = bytes
+		}
+	}
+}
+
+// producer retries of a failed send before the message is returned as error
+func WithProducerRetry(max int, backoff time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tuning.retryMax = &max
+			o.tuning.retryBackoff = backoff
+		}
+	}
+}
+
+// transactional producer timeout before the coordinator aborts an open transaction
+func WithTransactionTimeout(timeout time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.txnTimeout = timeout
+		}
+	}
+}
+
+// consumer only reads messages of committed transactions
+func WithReadCommitted(readCommitted bool) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.readCommitted = readCommitted
+		}
+	}
+}
+
+// consumer or producer sasl mechanism, one of SASLPlain, SASLScramSHA256,
+// SASLScramSHA512 and SASLOAuthBearer
+func WithSASLMechanism(mechanism string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.saslMechanism = mechanism
+		}
+	}
+}
+
+// consumer or producer sasl oauthbearer token provider
+func WithSASLTokenProvider(provider sarama.AccessTokenProvider) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.saslMechanism = SASLOAuthBearer
+			o.tokenProvider = provider
+		}
+	}
+}
+
+// consumer or producer tls ca bundle file, reloaded when the file changes
+func WithTLSCAFile(caFile string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tls.enable = true
+			o.tls.caFile = caFile
+		}
+	}
+}
+
+// consumer or producer tls ca bundle pem
+func WithTLSCAPEM(caPEM []byte) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tls.enable = true
+			o.tls.caPEM = caPEM
+		}
+	}
+}
+
+// consumer or producer tls client certificate files, reloaded when the files change
+func WithTLSClientCertFile(certFile, keyFile string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tls.enable = true
+			o.tls.certFile = certFile
+			o.tls.keyFile = keyFile
+		}
+	}
+}
+
+// consumer or producer tls client certificate pem
+func WithTLSClientCertPEM(certPEM, keyPEM []byte) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tls.enable = true
+			o.tls.certPEM = certPEM
+			o.tls.keyPEM = keyPEM
+		}
+	}
+}
+
+// consumer or producer tls server name, default is the broker host
+func WithTLSServerName(serverName string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tls.enable = true
+			o.tls.serverName = serverName
+		}
+	}
+}
+
+// consumer or producer tls without verifying the broker certificate
+func WithTLSInsecureSkipVerify(skip bool) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.tls.enable = true
+			o.tls.insecureSkipVerify = skip
+		}
+	}
+}
+
+// consumer starts a group without committed offsets from the first message at
+// or after t, like fromOldest it is ignored once the group committed
+func WithStartTime(t time.Time) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.startTime = t
+		}
+	}
+}
+
+// consumer paused state gauge
+func WithPausedVec(vec *monitor.KafkaPausedVec) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.pausedVec = vec
+		}
+	}
+}
+
+// consumer callback with the topic partitions claimed in a rebalance, called
+// before their messages are processed. Kafka versions before 2.0 return
+// ErrRebalanceHooks
+func WithOnAssigned(fn func(topicPartitions map[string][]int32)) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.onAssigned = fn
+		}
+	}
+}
+
+// consumer callback with the topic partitions given up in a rebalance or on
+// close, called after their messages are processed and before the offsets are
+// finally committed. Kafka versions before 2.0 return ErrRebalanceHooks
+func WithOnRevoked(fn func(topicPartitions map[string][]int32)) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.onRevoked = fn
+		}
+	}
+}
+
+// typed consumer handler of the messages failing to decode, its error is
+// handled like a process error
+func WithDecodeErrorHandler(fn func(msg *sarama.ConsumerMessage, err error) error) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.decodeError = fn
+		}
+	}
+}
+
+// lag collector interval between two collections, default is 30s
+func WithLagInterval(interval time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.lagInterval = interval
+		}
+	}
+}
+
+// consumer group partition assignment, sarama.BalanceStrategyRange (default),
+// BalanceStrategyRoundRobin or BalanceStrategySticky. Kafka versions before
+// 2.0 support range and round robin only
+func WithBalanceStrategy(strategy sarama.BalanceStrategy) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.group.strategy = strategy
+		}
+	}
+}
+
+// consumer group session timeout, a member not heard of for timeout leaves the
+// group, default is 30s
+func WithSessionTimeout(timeout time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.group.sessionTimeout = timeout
+		}
+	}
+}
+
+// consumer static group membership (group.instance.id), the member does not
+// leave the group on close and takes its partitions back without a rebalance
+// when it restarts within the session timeout. id must be unique in the group,
+// Kafka versions before 2.3 return ErrGroupInstanceID
+func WithGroupInstanceID(id string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.group.instanceID = id
+		}
+	}
+}
+
+// consumer group heartbeat interval, it must be lower than the session timeout,
+// default is 3s
+func WithHeartbeatInterval(interval time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.group.heartbeatInterval = interval
+		}
+	}
+}
+
+// consumer time a message may be processed before the partition stops being
+// fetched until it is done, default is 100ms
+func WithMaxProcessingTime(d time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.group.maxProcessingTime = d
+		}
+	}
+}
+
+// producer secondary cluster the producer fails over to while the primary
+// brokers are unhealthy, it uses the same credentials and tls options
+func WithSecondaryBrokers(brokers []string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.secondary = brokers
+		}
+	}
+}
+
+// producer fails over after threshold consecutive send errors or failed
+// health checks of the primary cluster and fails back after threshold healthy
+// checks, the primary is checked every interval. Default is 5 and 10s
+func WithFailover(threshold int, interval time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.failover.threshold = threshold
+			o.failover.interval = interval
+		}
+	}
+}
+
+// producer counters and active cluster gauge labelled by cluster
+func WithClusterVec(vec *monitor.KafkaClusterVec) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*Options); ok {
+			o.clusterVec = vec
+		}
+	}
+}
+
+// mirror source topics matching re, in addition to the ones of WithTopics. The
+// source topics are listed again every WithMirrorRefresh interval, the source
+// group is rejoined to mirror a topic created later
+func WithMirrorInclude(re *regexp.Regexp) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*mirrorOptions); ok {
+			o.include = re
+		}
+	}
+}
+
+// mirror interval between two listings of the source topics matched by
+// WithMirrorInclude, default is the metadata refresh frequency of sarama
+func WithMirrorRefresh(interval time.Duration) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*mirrorOptions); ok {
+			o.refresh = interval
+		}
+	}
+}
+
+// mirror source topics matching re are not mirrored, it wins over the includes
+func WithMirrorExclude(re *regexp.Regexp) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*mirrorOptions); ok {
+			o.exclude = re
+		}
+	}
+}
+
+// mirror destination topic of a source topic, default is the same name
+func WithMirrorRename(fn func(topic string) string) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*mirrorOptions); ok {
+			o.rename = fn
+		}
+	}
+}
+
+// mirror transformation of the message sent for src, returning nil skips it
+// and an error skips it as well after logging it
+func WithMirrorTransform(fn func(msg *sarama.ProducerMessage, src *sarama.ConsumerMessage) (*sarama.ProducerMessage, error)) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*mirrorOptions); ok {
+			o.transform = fn
+		}
+	}
+}
+
+// mirror throughput counter and lag gauge
+func WithMirrorVec(vec *monitor.KafkaMirrorVec) optFun {
+	return func(i interface{}) {
+		if o, ok := i.(*mirrorOptions); ok {
+			o.vec = vec
+		}
+	}
+}
+
 func WithLogger(log logger.Logi) optFun {
 	return func(i interface{}) {
 		if o, ok := i.(*Options); ok {
@@ -124,12 +661,13 @@ func WithLogger(log logger.Logi) optFun {
 }
 
 var (
-	ErrNilPoint  = errors.New("please init options first")
-	ErrGroupName = errors.New("consumer must set groupname")
-	ErrTopic     = errors.New("consumer must set topics")
-	ErrBrokers   = errors.New("consumer must set brokers")
-	ErrNumWorks  = errors.New("producer must set numworks")
-	ErrQueueSize = errors.New("producer must set queuesize")
+	ErrNilPoint   = errors.New("please init options first")
+	ErrGroupName  = errors.New("consumer must set groupname")
+	ErrTopic      = errors.New("consumer must set topics")
+	ErrBrokers    = errors.New("consumer must set brokers")
+	ErrNumWorks   = errors.New("producer must set numworks")
+	ErrQueueSize  = errors.New("producer must set queuesize")
+	ErrDeadLetter = errors.New("consumer dead-letter must set topic and producer")
 )
 
 func ValidConsumerOption(o *Options) error {
@@ -142,9 +680,12 @@ func ValidConsumerOption(o *Options) error {
 	if len(o.topics) == 0 {
 		return ErrTopic
 	}
-	if len(o.brokers) == 0 {
+	if len(o.brokers) == 0 && len(o.zookeepers) == 0 {
 		return ErrBrokers
 	}
+	if (o.dlqTopic == "") != (o.dlqProducer == nil) {
+		return ErrDeadLetter
+	}
 	return nil
 }
 
@@ -157,6 +698,15 @@ func FillProducerOption(o *Options) {
 	}
 }
 
+func FillBatchOption(o *Options) {
+	if o.batchSize <= 0 {
+		o.batchSize = 100
+	}
+	if o.batchLinger <= 0 {
+		o.batchLinger = time.Second
+	}
+}
+
 func ValidProducerOption(o *Options) error {
 	if o == nil {
 		return ErrNilPoint
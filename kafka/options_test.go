@@ -1,58 +1,48 @@
 package kafka
 
 import (
-	"context"
-	"fmt"
-	"github.com/Shopify/sarama"
 	"testing"
 	"time"
-)
 
-var (
-	brokers = []string{"172.25.23.57:9092"}
-	topics  = []string{"test"}
-	tChan   chan struct{}
-	closed  bool
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/kafka/kafkatest"
 )
 
 func TestNewConsumerProducer(t *testing.T) {
-	tChan = make(chan struct{})
-	consumerClient, err := NewConsumerV2("test-consumer-v1", "2.1.0.0", brokers, topics, testOptions)
+	cluster := kafkatest.NewCluster(t)
+	defer cluster.Close()
+
+	received := make(chan *sarama.ConsumerMessage, 1)
+	consumerClient, err := NewConsumerV2("test-consumer-v1", "2.1.0.0", []string{"test"}, cluster.Addrs(),
+		func(msg *sarama.ConsumerMessage) error {
+			received <- msg
+			return nil
+		}, WithFromOldest(true))
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	err = consumerClient.Start()
-	if err != nil {
-		t.Error(err)
-		return
+	if err = consumerClient.Start(); err != nil {
+		t.Fatal(err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	defer consumerClient.Close()
 
-	producerClient, err := NewProducerV2("test-p", "2.1.0.0", brokers)
+	producerClient, err := NewProducerV2("test-p", "2.1.0.0", cluster.Addrs())
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
 	producerClient.Start()
+	defer producerClient.Close()
 	producerClient.Send("test", []byte("test_data"))
 
 	select {
-	case <-tChan:
-		t.Log("ok")
-	case <-ctx.Done():
-		t.Error("timeout")
+	case msg := <-received:
+		if string(msg.Value) != "test_data" {
+			t.Errorf("received %s", msg.Value)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
 	}
-	producerClient.Close()
-	consumerClient.Close()
-}
-
-func testOptions(msg *sarama.ConsumerMessage) error {
-	fmt.Println(string(msg.Value))
-	if !closed {
-		closed = true
-		close(tChan)
+	if !cluster.WaitCommitted("test-consumer-v1", "test", 0, 1, 10*time.Second) {
+		t.Errorf("offset not committed: %d", cluster.Committed("test-consumer-v1", "test", 0))
 	}
-	return nil
 }
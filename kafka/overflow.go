@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+// OverflowPolicy decides what Producer does with a message when its queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowSpill writes the message to the local cache, it is the default
+	OverflowSpill OverflowPolicy = iota
+	// OverflowBlock waits for room in the queue until the context is done
+	OverflowBlock
+	// OverflowDropOldest drops the oldest queued message to make room
+	OverflowDropOldest
+	// OverflowDropNewest drops the message being sent
+	OverflowDropNewest
+)
+
+var ErrQueueFull = errors.New("producer queue is full")
+
+// handleOverflow handles msg when the queue is full according to policy, every
+// decision is counted in the monitor vec by its status
+func (p *Producer) handleOverflow(ctx context.Context, msg *sarama.ProducerMessage, status string, policy OverflowPolicy) error {
+	p.inc(msg.Topic, "queuefull")
+	switch policy {
+	case OverflowBlock:
+		p.inc(msg.Topic, "blocked")
+		select {
+		case p.queue <- msg:
+			p.inc(msg.Topic, status)
+			return nil
+		case <-ctx.Done():
+			p.inc(msg.Topic, "timeout")
+			return ctx.Err()
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case old := <-p.queue:
+				p.inc(old.Topic, "dropoldest")
+				if d, ok := old.Metadata.(*delivery); ok {
+					old.Metadata = d.metadata
+					d.report <- &DeliveryReport{Topic: old.Topic, Partition: -1, Offset: -1, Err: ErrQueueFull}
+				}
+			default:
+			}
+			select {
+			case p.queue <- msg:
+				p.inc(msg.Topic, status)
+				return nil
+			default:
+			}
+		}
+	case OverflowDropNewest:
+		p.inc(msg.Topic, "dropnewest")
+		return ErrQueueFull
+	default:
+		if err := producerWriteToLocal(p.localCache, msg); err != nil {
+			p.inc(msg.Topic, "spillerror")
+			return err
+		}
+		p.inc(msg.Topic, "spill")
+		return nil
+	}
+}
+
+func (p *Producer) inc(topic, status string) {
+	if p.monitor != nil {
+		p.monitor.Inc(&monitor.KafkaLabels{Partition: -1, Topic: topic, Status: status})
+	}
+}
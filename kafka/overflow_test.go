@@ -0,0 +1,57 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestOverflowPolicy(t *testing.T) {
+	msg := func(v string) *sarama.ProducerMessage {
+		return &sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder(v)}
+	}
+
+	p := &Producer{queue: make(chan *sarama.ProducerMessage, 1), overflow: OverflowDropNewest}
+	p.Send("test", []byte("first"))
+	if err := p.SendMessageContext(context.Background(), msg("second")); err != ErrQueueFull {
+		t.Errorf("drop newest err %v", err)
+	}
+	if v, _ := (<-p.queue).Value.Encode(); string(v) != "first" {
+		t.Errorf("drop newest kept %s", v)
+	}
+
+	p = &Producer{queue: make(chan *sarama.ProducerMessage, 1), overflow: OverflowDropOldest}
+	report := p.SendAsync(context.Background(), msg("first"))
+	if err := p.SendMessageContext(context.Background(), msg("second")); err != nil {
+		t.Errorf("drop oldest err %v", err)
+	}
+	if v, _ := (<-p.queue).Value.Encode(); string(v) != "second" {
+		t.Errorf("drop oldest kept %s", v)
+	}
+	if r := <-report; r.Err != ErrQueueFull {
+		t.Errorf("dropped message report %v", r.Err)
+	}
+
+	p = &Producer{queue: make(chan *sarama.ProducerMessage, 1), overflow: OverflowBlock, timeout: 10 * time.Millisecond}
+	p.Send("test", []byte("first"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.SendMessageContext(ctx, msg("second")); err != context.DeadlineExceeded {
+		t.Errorf("block err %v", err)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-p.queue
+	}()
+	if err := p.SendContext(context.Background(), "test", []byte("third")); err != nil {
+		t.Errorf("block err %v", err)
+	}
+
+	p = &Producer{queue: make(chan *sarama.ProducerMessage, 1)}
+	p.Send("test", []byte("first"))
+	if err := p.SendContext(context.Background(), "test", []byte("second")); err != ErrLocalStoreNil {
+		t.Errorf("spill err %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package kafka
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// stickyMessages is the number of keyless messages the sticky partitioner
+// writes to a partition before it picks another one
+const stickyMessages = 100
+
+// NewMurmur2Partitioner hashes the message key the way the Java client's
+// default partitioner does, so a key goes to the same partition from Go and
+// Java producers. Messages without key are spread randomly.
+// The other partitioners are sarama.NewHashPartitioner (fnv),
+// sarama.NewRoundRobinPartitioner and sarama.NewManualPartitioner (explicit partition)
+func NewMurmur2Partitioner(topic string) sarama.Partitioner {
+	return &murmur2Partitioner{random: sarama.NewRandomPartitioner(topic)}
+}
+
+type murmur2Partitioner struct {
+	random sarama.Partitioner
+}
+
+func (p *murmur2Partitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if msg.Key == nil {
+		return p.random.Partition(msg, numPartitions)
+	}
+	return murmur2Partition(msg, numPartitions)
+}
+
+func (p *murmur2Partitioner) RequiresConsistency() bool {
+	return true
+}
+
+func (p *murmur2Partitioner) MessageRequiresConsistency(msg *sarama.ProducerMessage) bool {
+	return msg.Key != nil
+}
+
+// NewStickyPartitioner hashes keyed messages like NewMurmur2Partitioner and
+// sticks keyless messages to one partition for a while, so they fill larger batches
+func NewStickyPartitioner(topic string) sarama.Partitioner {
+	return &stickyPartitioner{
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		partition: -1,
+	}
+}
+
+type stickyPartitioner struct {
+	rand      *rand.Rand
+	partition int32
+	count     int
+}
+
+func (p *stickyPartitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if msg.Key != nil {
+		return murmur2Partition(msg, numPartitions)
+	}
+	if p.partition < 0 || p.partition >= numPartitions || p.count >= stickyMessages {
+		next := int32(p.rand.Intn(int(numPartitions)))
+		if numPartitions > 1 && next == p.partition {
+			next = (next + 1) % numPartitions
+		}
+		p.partition = next
+		p.count = 0
+	}
+	p.count++
+	return p.partition, nil
+}
+
+func (p *stickyPartitioner) RequiresConsistency() bool {
+	return true
+}
+
+func (p *stickyPartitioner) MessageRequiresConsistency(msg *sarama.ProducerMessage) bool {
+	return msg.Key != nil
+}
+
+func murmur2Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	key, err := msg.Key.Encode()
+	if err != nil {
+		return -1, err
+	}
+	// Java: Utils.toPositive(Utils.murmur2(key)) % numPartitions
+	return (murmur2(key) & 0x7fffffff) % numPartitions, nil
+}
+
+// murmur2 is the 32 bit murmur2 hash of the Java client's Utils.murmur2
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	length := len(data)
+	h := seed ^ uint32(length)
+	length4 := length / 4
+	for i := 0; i < length4; i++ {
+		i4 := i * 4
+		k := uint32(data[i4]) | uint32(data[i4+1])<<8 | uint32(data[i4+2])<<16 | uint32(data[i4+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
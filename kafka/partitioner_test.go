@@ -0,0 +1,63 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// hashes and partitions computed by the Java client, Utils.murmur2 and
+// Utils.toPositive(Utils.murmur2(key)) % numPartitions
+var javaPartitions = []struct {
+	key  string
+	hash int32
+	p12  int32
+	p100 int32
+}{
+	{"21", -973932308, 0, 40},
+	{"foobar", -790332482, 6, 66},
+	{"a-little-bit-long-string", -985981536, 8, 12},
+	{"a-little-bit-longer-string", -1486304829, 11, 19},
+	{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971, 5, 77},
+	{"abc", 479470107, 3, 7},
+}
+
+func TestMurmur2Partitioner(t *testing.T) {
+	p := NewMurmur2Partitioner("test")
+	for _, tc := range javaPartitions {
+		if h := murmur2([]byte(tc.key)); h != tc.hash {
+			t.Errorf("murmur2(%q) = %d, want %d", tc.key, h, tc.hash)
+		}
+		msg := &sarama.ProducerMessage{Topic: "test", Key: sarama.StringEncoder(tc.key)}
+		for n, want := range map[int32]int32{12: tc.p12, 100: tc.p100} {
+			if got, err := p.Partition(msg, n); err != nil || got != want {
+				t.Errorf("partition(%q, %d) = %d, want %d", tc.key, n, got, want)
+			}
+		}
+	}
+	if !p.RequiresConsistency() {
+		t.Error("murmur2 partitioner must require consistency")
+	}
+	if got, err := p.Partition(&sarama.ProducerMessage{Topic: "test"}, 12); err != nil || got < 0 || got >= 12 {
+		t.Errorf("keyless partition %d %v", got, err)
+	}
+}
+
+func TestStickyPartitioner(t *testing.T) {
+	p := NewStickyPartitioner("test")
+	msg := &sarama.ProducerMessage{Topic: "test", Key: sarama.StringEncoder("foobar")}
+	if got, _ := p.Partition(msg, 12); got != 6 {
+		t.Errorf("keyed partition %d, want 6", got)
+	}
+
+	keyless := &sarama.ProducerMessage{Topic: "test"}
+	first, _ := p.Partition(keyless, 12)
+	for i := 1; i < stickyMessages; i++ {
+		if got, _ := p.Partition(keyless, 12); got != first {
+			t.Fatalf("message %d moved from partition %d to %d", i, first, got)
+		}
+	}
+	if got, _ := p.Partition(keyless, 12); got == first {
+		t.Errorf("partition %d kept after %d messages", got, stickyMessages)
+	}
+}
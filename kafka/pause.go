@@ -0,0 +1,105 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/jinglov/gomisc/monitor"
+)
+
+// pauser holds back the messages of paused partitions. The consumers keep
+// their group session and heartbeats, fetching stops once the buffers of a
+// paused partition are full
+type pauser struct {
+	mu     sync.Mutex
+	group  string
+	all    bool
+	paused map[topicPartition]bool
+	// resumed is closed and replaced on every resume to wake the waiters
+	resumed chan struct{}
+	vec     *monitor.KafkaPausedVec
+}
+
+func newPauser(options *Options) *pauser {
+	return &pauser{
+		group:   options.Name,
+		paused:  make(map[topicPartition]bool),
+		resumed: make(chan struct{}),
+		vec:     options.pausedVec,
+	}
+}
+
+func (p *pauser) pause(topicPartitions map[string][]int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for topic, partitions := range topicPartitions {
+		for _, partition := range partitions {
+			p.paused[topicPartition{topic: topic, partition: partition}] = true
+			p.setGauge(topic, partition, true)
+		}
+	}
+}
+
+func (p *pauser) pauseAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.all = true
+	p.setGauge("", -1, true)
+}
+
+func (p *pauser) resume(topicPartitions map[string][]int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for topic, partitions := range topicPartitions {
+		for _, partition := range partitions {
+			delete(p.paused, topicPartition{topic: topic, partition: partition})
+			p.setGauge(topic, partition, false)
+		}
+	}
+	p.wake()
+}
+
+// resumeAll resumes all partitions, including the ones paused one by one
+func (p *pauser) resumeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.all = false
+	p.setGauge("", -1, false)
+	for tp := range p.paused {
+		p.setGauge(tp.topic, tp.partition, false)
+	}
+	p.paused = make(map[topicPartition]bool)
+	p.wake()
+}
+
+func (p *pauser) wake() {
+	close(p.resumed)
+	p.resumed = make(chan struct{})
+}
+
+func (p *pauser) setGauge(topic string, partition int32, paused bool) {
+	if p.vec != nil {
+		p.vec.SetPaused(&monitor.KafkaPausedLabels{Group: p.group, Topic: topic, Partition: partition}, paused)
+	}
+}
+
+// wait blocks while the partition is paused, false if done is closed first
+func (p *pauser) wait(done <-chan struct{}, topic string, partition int32) bool {
+	if p == nil {
+		return true
+	}
+	tp := topicPartition{topic: topic, partition: partition}
+	for {
+		p.mu.Lock()
+		if !p.all && !p.paused[tp] {
+			p.mu.Unlock()
+			return true
+		}
+		resumed := p.resumed
+		p.mu.Unlock()
+		select {
+		case <-resumed:
+		case <-done:
+			return false
+		}
+	}
+}
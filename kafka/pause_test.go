@@ -0,0 +1,85 @@
+package kafka
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+func TestPauser(t *testing.T) {
+	vec := monitor.NewKafkaPausedVec("test", "kafka", "paused")
+	p := newPauser(&Options{Name: "test-group", pausedVec: vec})
+	p.pause(map[string][]int32{"test": {1}})
+	if !p.wait(nil, "test", 0) {
+		t.Error("partition 0 is not paused")
+	}
+	labels := map[string]string{"group": "test-group", "topic": "test", "partition": "1"}
+	if v, ok := metricValue(t, "test_kafka_paused", labels); !ok || v != 1 {
+		t.Errorf("paused gauge %v", v)
+	}
+
+	waited := make(chan bool)
+	go func() {
+		waited <- p.wait(nil, "test", 1)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("paused partition not held back")
+	case <-time.After(10 * time.Millisecond):
+	}
+	p.resume(map[string][]int32{"test": {1}})
+	if !<-waited {
+		t.Error("resumed partition not released")
+	}
+	if v, ok := metricValue(t, "test_kafka_paused", labels); !ok || v != 0 {
+		t.Errorf("resumed gauge %v", v)
+	}
+
+	p.pauseAll()
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+	}()
+	if p.wait(done, "test", 0) {
+		t.Error("wait must return false when done")
+	}
+	p.resumeAll()
+	if !p.wait(nil, "test", 0) {
+		t.Error("partition not resumed")
+	}
+}
+
+func TestConsumer2Pause(t *testing.T) {
+	var processed int32
+	options := &Options{Name: "test-group"}
+	k := &Consumer2{
+		handler: newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+			atomic.AddInt32(&processed, 1)
+			return nil
+		}),
+		pauser: newPauser(options),
+	}
+	k.PauseAll()
+	session := newTestSession(nil)
+	claim := newTestClaim("test", 0, 10)
+	close(claim.messages)
+	done := make(chan error)
+	go func() {
+		done <- k.ConsumeClaim(session, claim)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&processed); n != 0 || session.offset("test", 0) != 0 {
+		t.Errorf("paused consumer processed %d messages", n)
+	}
+	k.ResumeAll()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&processed); n != 10 || session.offset("test", 0) != 10 {
+		t.Errorf("processed %d messages, marked offset %d", n, session.offset("test", 0))
+	}
+}
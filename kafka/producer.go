@@ -1,12 +1,14 @@
 package kafka
 
 import (
+	"context"
 	"errors"
 	"github.com/Shopify/sarama"
 	"github.com/jinglov/gomisc/drivers"
 	"github.com/jinglov/gomisc/logger"
 	"github.com/jinglov/gomisc/monitor"
 	"sync"
+	"time"
 )
 
 type Producer struct {
@@ -17,15 +19,29 @@ type Producer struct {
 	wg         *sync.WaitGroup
 	monitor    *monitor.KafkaVec
 	log        logger.Logi
+	overflow   OverflowPolicy
+	timeout    time.Duration
+	state      *shutdownState
+	failover   *failover
 }
 
 type producerWorker struct {
 	producer   sarama.AsyncProducer
+	secondary  sarama.AsyncProducer
+	failover   *failover
 	queue      chan *sarama.ProducerMessage
 	monitor    *monitor.KafkaVec
 	localCache *drivers.LocalStore
 	version    sarama.KafkaVersion
 	log        logger.Logi
+	state      *shutdownState
+
+	// inflight holds the messages given to the sarama producer and not yet
+	// acknowledged, they are abandoned to Shutdown when its deadline passes
+	mu        sync.Mutex
+	inflight  map[*sarama.ProducerMessage]bool
+	abandoned bool
+	drained   chan struct{}
 }
 
 func NewProducer(producerName, user, password string, brokers []string, numWorkers, queueSize int, monitor *monitor.KafkaVec, cachePath string, version string, log logger.Logi) (*Producer, error) {
@@ -45,7 +61,8 @@ func NewProducer(producerName, user, password string, brokers []string, numWorke
 	}
 	v := kafkaVersion(version)
 	for i := 0; i < numWorkers; i++ {
-		w, err := newProducerWorker(producerName, user, password, brokers, p.queue, monitor, p.localCache, v, log)
+		options := &Options{Name: producerName, brokers: brokers, user: user, password: password, vec: monitor, log: log}
+		w, err := newProducerWorker(options, p.queue, p.localCache, v)
 		if err != nil {
 			return nil, err
 		}
@@ -59,92 +76,182 @@ func (p *Producer) Start() {
 		p.localCache.Start()
 	}
 	p.wg = &sync.WaitGroup{}
+	p.state = newShutdownState()
 	for i := 0; i < len(p.works); i++ {
+		p.works[i].state = p.state
 		p.wg.Add(1)
 		p.works[i].start(p.wg)
 	}
+	if p.failover != nil {
+		p.failover.start()
+	}
 }
 
 // 关闭kafka时需要close掉worker的queue才可以
 func (p *Producer) Close() {
-	if p.localCache != nil {
-		p.localCache.Stop()
-	}
-	close(p.queue)
-	p.wg.Wait()
-	if p.localCache != nil {
-		p.localCache.Close()
-	}
+	_, _ = p.Shutdown(context.Background())
 }
 
 func (p *Producer) Send(topic string, data []byte) {
-	msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data)}
+	p.SendMessage(&sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data)})
+}
+
+func (p *Producer) SendUseKey(topic string, data []byte, key sarama.Encoder) {
+	p.SendMessage(&sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data), Key: key})
+}
+
+// SendContext is Send returning the overflow error, OverflowBlock waits until ctx is done
+func (p *Producer) SendContext(ctx context.Context, topic string, data []byte) error {
+	return p.SendMessageContext(ctx, &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data)})
+}
+
+// DeliveryReport is the broker acknowledgement of a message sent by SendSync or SendAsync
+type DeliveryReport struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+// delivery replaces the message metadata while it is in flight so the worker
+// can report back to the sender
+type delivery struct {
+	metadata interface{}
+	report   chan *DeliveryReport
+}
+
+// SendSync sends msg and waits until the broker acknowledges it or ctx is done.
+// A failed message is returned to the caller instead of being cached locally.
+// A copy of msg is sent so the caller owns msg again once SendSync returned,
+// even if it is still in flight when ctx is done
+func (p *Producer) SendSync(ctx context.Context, msg *sarama.ProducerMessage) (int32, int64, error) {
+	m := *msg
 	select {
-	case p.queue <- msg:
-		if p.monitor != nil {
-			p.monitor.Inc(&monitor.KafkaLabels{Partition: -1, Topic: msg.Topic, Status: "sent"})
-		}
-	default:
-		if p.monitor != nil {
-			p.monitor.Inc(&monitor.KafkaLabels{Partition: -1, Topic: msg.Topic, Status: "queuefull"})
-		}
-		e := producerWriteToLocal(p.localCache, msg)
-		if e != nil && p.log != nil {
-			p.log.Errorf("failed to write to local: %s", e.Error())
-		}
+	case r := <-p.SendAsync(ctx, &m):
+		return r.Partition, r.Offset, r.Err
+	case <-ctx.Done():
+		return -1, -1, ctx.Err()
 	}
 }
 
-func (p *Producer) SendUseKey(topic string, data []byte, key sarama.Encoder) {
-	msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data), Key: key}
+// SendAsync queues msg and returns a channel receiving its delivery report.
+// It blocks while the queue is full until ctx is done
+func (p *Producer) SendAsync(ctx context.Context, msg *sarama.ProducerMessage) <-chan *DeliveryReport {
+	report := make(chan *DeliveryReport, 1)
+	msg.Metadata = &delivery{metadata: msg.Metadata, report: report}
 	select {
 	case p.queue <- msg:
-		if p.monitor != nil {
-			p.monitor.Inc(&monitor.KafkaLabels{Partition: -1, Topic: msg.Topic, Status: "sent"})
-		}
-	default:
-		if p.monitor != nil {
-			p.monitor.Inc(&monitor.KafkaLabels{Partition: -1, Topic: msg.Topic, Status: "queuefull"})
-		}
-		e := producerWriteToLocal(p.localCache, msg)
-		if e != nil && p.log != nil {
-			p.log.Errorf("failed to write to local: %s", e.Error())
-		}
+		p.inc(msg.Topic, "sent")
+	case <-ctx.Done():
+		p.inc(msg.Topic, "timeout")
+		msg.Metadata = msg.Metadata.(*delivery).metadata
+		report <- &DeliveryReport{Topic: msg.Topic, Partition: -1, Offset: -1, Err: ctx.Err()}
 	}
+	return report
 }
 
+// SendMessage sends msg keeping its key, headers and timestamp, they are
+// preserved as well when the message is cached locally
+func (p *Producer) SendMessage(msg *sarama.ProducerMessage) {
+	ctx, cancel := p.sendContext()
+	defer cancel()
+	_ = p.enqueue(ctx, msg, "sent", p.overflow)
+}
+
+// SendMessageContext is SendMessage returning the overflow error, OverflowBlock
+// waits until ctx is done
+func (p *Producer) SendMessageContext(ctx context.Context, msg *sarama.ProducerMessage) error {
+	return p.enqueue(ctx, msg, "sent", p.overflow)
+}
+
+// Retry replays a message read from the local cache, it goes back to the
+// cache when the queue is full whatever the overflow policy
 func (p *Producer) Retry(topic string, data []byte) {
-	msg := &sarama.ProducerMessage{Topic: topic, Value: sarama.ByteEncoder(data)}
+	_ = p.enqueue(context.Background(), decodeSpill(topic, data), "retry", OverflowSpill)
+}
+
+// enqueue 投递到worker队列，队列满时按overflow策略处理
+func (p *Producer) enqueue(ctx context.Context, msg *sarama.ProducerMessage, status string, policy OverflowPolicy) error {
 	select {
 	case p.queue <- msg:
-		if p.monitor != nil {
-			p.monitor.Inc(&monitor.KafkaLabels{Partition: -1, Topic: msg.Topic, Status: "retry"})
-		}
+		p.inc(msg.Topic, status)
+		return nil
 	default:
-		if p.monitor != nil {
-			p.monitor.Inc(&monitor.KafkaLabels{Partition: -1, Topic: msg.Topic, Status: "queuefull"})
-		}
-		e := producerWriteToLocal(p.localCache, msg)
-		if e != nil && p.log != nil {
-			p.log.Errorf("failed to write to local: %s", e.Error())
-		}
 	}
+	err := p.handleOverflow(ctx, msg, status, policy)
+	if err != nil && p.log != nil {
+		p.log.Errorf("failed to send message to %s: %s", msg.Topic, err.Error())
+	}
+	return err
 }
 
-func newProducerWorker(producerName, user, password string, brokers []string, queue chan *sarama.ProducerMessage, monitor *monitor.KafkaVec, localCache *drivers.LocalStore, version sarama.KafkaVersion, log logger.Logi) (*producerWorker, error) {
-	c := sarama.NewConfig()
-	c.ClientID = producerName
-	c.Version = version
-	if user != "" {
-		c.Net.SASL.Enable = true
-		c.Net.SASL.User = user
-		c.Net.SASL.Password = password
+// sendContext is the context of the sends without one, it expires after the block timeout
+func (p *Producer) sendContext() (context.Context, context.CancelFunc) {
+	if p.timeout > 0 {
+		return context.WithTimeout(context.Background(), p.timeout)
+	}
+	return context.Background(), func() {}
+}
+
+// producerTuning holds the producer settings overriding the sarama defaults,
+// unset fields keep the defaults
+type producerTuning struct {
+	compression      *sarama.CompressionCodec
+	compressionLevel *int
+	requiredAcks     *sarama.RequiredAcks
+	flushFrequency   time.Duration
+	flushBytes       int
+	flushMessages    int
+	flushMaxMessages int
+	maxMessageBytes  int
+	retryMax         *int
+	retryBackoff     time.Duration
+}
+
+func (t *producerTuning) apply(c *sarama.Config) {
+	if t.compression != nil {
+		c.Producer.Compression = *t.compression
+	}
+	if t.compressionLevel != nil {
+		c.Producer.CompressionLevel = *t.compressionLevel
+	}
+	if t.requiredAcks != nil {
+		c.Producer.RequiredAcks = *t.requiredAcks
+	}
+	if t.flushFrequency > 0 {
+		c.Producer.Flush.Frequency = t.flushFrequency
+	}
+	if t.flushBytes > 0 {
+		c.Producer.Flush.Bytes = t.flushBytes
+	}
+	if t.flushMessages > 0 {
+		c.Producer.Flush.Messages = t.flushMessages
+	}
+	if t.flushMaxMessages > 0 {
+		c.Producer.Flush.MaxMessages = t.flushMaxMessages
+	}
+	if t.maxMessageBytes > 0 {
+		c.Producer.MaxMessageBytes = t.maxMessageBytes
+	}
+	if t.retryMax != nil {
+		c.Producer.Retry.Max = *t.retryMax
+	}
+	if t.retryBackoff > 0 {
+		c.Producer.Retry.Backoff = t.retryBackoff
+	}
+}
+
+func newProducerWorker(options *Options, queue chan *sarama.ProducerMessage, localCache *drivers.LocalStore, version sarama.KafkaVersion) (*producerWorker, error) {
+	c, err := newProducerConfig(options, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.secondary) > 0 {
+		// 任一集群不可达时也要能创建producer, 由failover切换
+		c.Metadata.Full = false
 	}
-	c.Producer.Compression = sarama.CompressionSnappy
-	c.Producer.Return.Successes = true
-	c.Producer.Return.Errors = true
 	// c.ChannelBufferSize = conf.Load().Report.KafkaBufferSize
-	p, err := sarama.NewAsyncProducer(brokers, c)
+	p, err := sarama.NewAsyncProducer(options.brokers, c)
 	if err != nil {
 		return nil, err
 	}
@@ -152,43 +259,118 @@ func newProducerWorker(producerName, user, password string, brokers []string, qu
 	w := &producerWorker{
 		producer:   p,
 		queue:      queue,
-		monitor:    monitor,
+		monitor:    options.vec,
 		localCache: localCache,
 	}
-	w.log = log
+	w.log = options.log
+	if len(options.secondary) > 0 {
+		if w.secondary, err = sarama.NewAsyncProducer(options.secondary, c); err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+	}
 	return w, nil
 }
 
+func newProducerConfig(options *Options, version sarama.KafkaVersion) (*sarama.Config, error) {
+	c := sarama.NewConfig()
+	c.ClientID = options.Name
+	c.Version = version
+	if err := configureNet(c, options); err != nil {
+		return nil, err
+	}
+	if options.partitioner != nil {
+		c.Producer.Partitioner = options.partitioner
+	}
+	c.Producer.Compression = sarama.CompressionSnappy
+	c.Producer.Return.Successes = true
+	c.Producer.Return.Errors = true
+	if options.idempotent {
+		// 幂等写入要求acks=all且单连接只有一个在途请求
+		c.Producer.Idempotent = true
+		c.Producer.RequiredAcks = sarama.WaitForAll
+		c.Net.MaxOpenRequests = 1
+	}
+	if options.ordered {
+		c.Net.MaxOpenRequests = 1
+	}
+	// 调优参数在幂等设置之后应用, 冲突的配置由sarama校验时报错
+	options.tuning.apply(c)
+	return c, nil
+}
+
 func (pw *producerWorker) start(wg *sync.WaitGroup) {
 	defer wg.Done()
+	pw.inflight = make(map[*sarama.ProducerMessage]bool)
+	pw.drained = make(chan struct{})
 	// 接收消息
 	wg.Add(1)
 	go pw.doMessage(wg)
 	// 接收成功通知
 	wg.Add(1)
-	go pw.doSuccess(wg)
+	go pw.doSuccess(wg, pw.producer, primaryCluster)
 	// 接收错误通知
 	wg.Add(1)
-	go pw.doError(wg)
+	go pw.doError(wg, pw.producer, primaryCluster)
+	if pw.secondary != nil {
+		wg.Add(2)
+		go pw.doSuccess(wg, pw.secondary, secondaryCluster)
+		go pw.doError(wg, pw.secondary, secondaryCluster)
+	}
+}
+
+// target is the producer of the active cluster and a channel closed once it
+// changes, nil without failover
+func (pw *producerWorker) target() (sarama.AsyncProducer, <-chan struct{}) {
+	if pw.failover == nil {
+		return pw.producer, nil
+	}
+	changed := pw.failover.changed()
+	if pw.failover.cluster() == secondaryCluster {
+		return pw.secondary, changed
+	}
+	return pw.producer, changed
 }
 
 func (pw *producerWorker) doMessage(wg *sync.WaitGroup) {
 	defer wg.Done()
+	for e := range pw.queue {
+		if !pw.track(e) {
+			// Shutdown gave up waiting, the rest of the queue is persisted
+			pw.persist(e, pw.state.cause)
+			continue
+		}
+		pw.send(e)
+	}
+	close(pw.drained)
+	_ = pw.close()
+}
+
+// send hands e to the producer of the active cluster, a worker blocked on a
+// stalled cluster moves on to the other one when the producer fails over
+func (pw *producerWorker) send(e *sarama.ProducerMessage) {
 	for {
+		target, changed := pw.target()
 		select {
-		case e, ok := <-pw.queue:
-			if !ok {
-				_ = pw.close()
-				return
-			}
-			pw.producer.Input() <- e
+		case target.Input() <- e:
+			return
+		case <-changed:
+		case <-pw.state.expired:
+			return
 		}
 	}
 }
 
-func (pw *producerWorker) doSuccess(wg *sync.WaitGroup) {
+func (pw *producerWorker) doSuccess(wg *sync.WaitGroup, producer sarama.AsyncProducer, cluster int32) {
 	defer wg.Done()
-	for m := range pw.producer.Successes() {
+	for m := range producer.Successes() {
+		if !pw.untrack(m) {
+			continue
+		}
+		if pw.failover != nil {
+			pw.failover.success(cluster, m.Topic)
+		}
+		pw.state.count(1, 0, 0)
 		if pw.log != nil {
 			pw.log.Debugf("success")
 			pw.log.Debugf("%v", m.Value)
@@ -196,23 +378,35 @@ func (pw *producerWorker) doSuccess(wg *sync.WaitGroup) {
 		if pw.monitor != nil {
 			pw.monitor.Inc(&monitor.KafkaLabels{Partition: m.Partition, Topic: m.Topic, Status: "ok"})
 		}
+		if d, ok := m.Metadata.(*delivery); ok {
+			m.Metadata = d.metadata
+			d.report <- &DeliveryReport{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset}
+		}
 	}
 }
 
-func (pw *producerWorker) doError(wg *sync.WaitGroup) {
+func (pw *producerWorker) doError(wg *sync.WaitGroup, producer sarama.AsyncProducer, cluster int32) {
 	defer wg.Done()
-	for err := range pw.producer.Errors() {
-		if err == nil {
+	for err := range producer.Errors() {
+		if err == nil || !pw.untrack(err.Msg) {
 			continue
 		}
+		if pw.failover != nil && err.Err != sarama.ErrMessageSizeTooLarge {
+			pw.failover.failure(cluster, err.Msg.Topic)
+		}
 		if pw.monitor != nil {
 			pw.monitor.Inc(&monitor.KafkaLabels{Partition: err.Msg.Partition, Topic: err.Msg.Topic, Status: "error"})
 		}
+		if _, ok := err.Msg.Metadata.(*delivery); ok {
+			pw.persist(err.Msg, err.Err)
+			continue
+		}
 		p, e := err.Msg.Value.Encode()
 		if e != nil {
 			if pw.log != nil {
 				pw.log.Errorf("failed to get message payload from error: %s", e.Error())
 			}
+			pw.state.count(0, 0, 1)
 			continue
 		}
 
@@ -220,6 +414,7 @@ func (pw *producerWorker) doError(wg *sync.WaitGroup) {
 			if pw.log != nil {
 				pw.log.Errorf("discard message because the size is too large: %d", len(p))
 			}
+			pw.state.count(0, 0, 1)
 			continue
 		}
 		if pw.log != nil {
@@ -229,15 +424,73 @@ func (pw *producerWorker) doError(wg *sync.WaitGroup) {
 		if pw.monitor != nil {
 			pw.monitor.Inc(&monitor.KafkaLabels{Partition: err.Msg.Partition, Topic: err.Msg.Topic, Status: "errorcache"})
 		}
-		e = producerWriteToLocal(pw.localCache, err.Msg)
-		if e != nil && pw.log != nil {
+		pw.persist(err.Msg, err.Err)
+	}
+}
+
+// track records msg as in flight, it returns false once the worker is abandoned
+func (pw *producerWorker) track(msg *sarama.ProducerMessage) bool {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.abandoned {
+		return false
+	}
+	pw.inflight[msg] = true
+	return true
+}
+
+// untrack returns false when msg was abandoned and already persisted by Shutdown
+func (pw *producerWorker) untrack(msg *sarama.ProducerMessage) bool {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if !pw.inflight[msg] {
+		return false
+	}
+	delete(pw.inflight, msg)
+	return true
+}
+
+// abandon returns the messages still in flight, their acknowledgements are
+// ignored from now on
+func (pw *producerWorker) abandon() []*sarama.ProducerMessage {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.abandoned = true
+	msgs := make([]*sarama.ProducerMessage, 0, len(pw.inflight))
+	for m := range pw.inflight {
+		msgs = append(msgs, m)
+	}
+	pw.inflight = make(map[*sarama.ProducerMessage]bool)
+	return msgs
+}
+
+// persist writes a failed msg to the local store, a message of SendAsync is
+// reported to its sender with err instead
+func (pw *producerWorker) persist(msg *sarama.ProducerMessage, err error) {
+	if d, ok := msg.Metadata.(*delivery); ok {
+		msg.Metadata = d.metadata
+		d.report <- &DeliveryReport{Topic: msg.Topic, Partition: -1, Offset: -1, Err: err}
+		pw.state.count(0, 0, 1)
+		return
+	}
+	if e := pw.state.writeToLocal(pw.localCache, msg); e != nil {
+		if pw.log != nil {
 			pw.log.Errorf("failed to write to local: %s", e.Error())
 		}
+		pw.state.count(0, 0, 1)
+		return
 	}
+	pw.state.count(0, 1, 0)
 }
 
 func (pw *producerWorker) close() error {
-	return pw.producer.Close()
+	err := pw.producer.Close()
+	if pw.secondary != nil {
+		if e := pw.secondary.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 var ErrLocalStoreNil = errors.New("local store not init")
@@ -246,7 +499,7 @@ func producerWriteToLocal(d *drivers.LocalStore, msg *sarama.ProducerMessage) er
 	if d == nil {
 		return ErrLocalStoreNil
 	}
-	v, err := msg.Value.Encode()
+	v, err := encodeSpill(msg)
 	if err != nil {
 		return err
 	}
@@ -263,6 +516,10 @@ func NewProducerV2(producerName, version string, brokers []string, opts ...optFu
 		o(options)
 	}
 	FillProducerOption(options)
+	if options.ordered {
+		// the workers share the queue, a second one would reorder it
+		options.numWorkers = 1
+	}
 	err := ValidProducerOption(options)
 	if err != nil {
 		return nil, err
@@ -273,6 +530,9 @@ func NewProducerV2(producerName, version string, brokers []string, opts ...optFu
 		works:      make([]*producerWorker, options.numWorkers),
 		queue:      make(chan *sarama.ProducerMessage, options.queueSize),
 		monitor:    options.vec,
+		log:        options.log,
+		overflow:   options.overflowPolicy,
+		timeout:    options.blockTimeout,
 	}
 	if options.cachePath != "" {
 		p.localCache, err = drivers.NewLocalStore(options.cachePath, p.Retry, 10, options.log)
@@ -281,11 +541,17 @@ func NewProducerV2(producerName, version string, brokers []string, opts ...optFu
 		}
 	}
 	v := kafkaVersion(version)
+	if len(options.secondary) > 0 {
+		if p.failover, err = newFailover(options, v); err != nil {
+			return nil, err
+		}
+	}
 	for i := 0; i < p.numWorkers; i++ {
-		w, err := newProducerWorker(producerName, options.user, options.password, options.brokers, p.queue, p.monitor, p.localCache, v, options.log)
+		w, err := newProducerWorker(options, p.queue, p.localCache, v)
 		if err != nil {
 			return nil, err
 		}
+		w.failover = p.failover
 		p.works[i] = w
 	}
 	return p, nil
@@ -1,14 +1,175 @@
 package kafka
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/jinglov/gomisc/kafka/kafkatest"
+)
 
 func TestNewProducerV2(t *testing.T) {
-	pc, err := NewProducerV2("test-p", "2.1.0.0", brokers)
+	cluster := kafkatest.NewCluster(t)
+	defer cluster.Close()
+	cluster.CreateTopic("test", 2)
+
+	pc, err := NewProducerV2("test-p", "2.1.0.0", cluster.Addrs(), WithProducerRetry(0, time.Millisecond))
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
 	pc.Start()
-	pc.Send("teest", []byte("test_data"))
-	t.Log(pc)
+	defer pc.Close()
+	pc.Send("test", []byte("test_data"))
+	if msgs := cluster.WaitMessages("test", 1, 10*time.Second); len(msgs) != 1 || string(msgs[0].Value) != "test_data" {
+		t.Fatalf("messages %v", msgs)
+	}
+
+	msg := &sarama.ProducerMessage{Topic: "test", Key: sarama.StringEncoder("key"), Value: sarama.StringEncoder("sync")}
+	partition, offset, err := pc.SendSync(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored *sarama.ConsumerMessage
+	for _, m := range cluster.Messages("test") {
+		if m.Partition == partition && m.Offset == offset {
+			stored = m
+		}
+	}
+	if stored == nil || string(stored.Key) != "key" || string(stored.Value) != "sync" {
+		t.Errorf("message sent to %d at %d not stored", partition, offset)
+	}
+
+	cluster.SetProduceError("test", partition, sarama.ErrMessageSizeTooLarge)
+	if _, _, err = pc.SendSync(context.Background(), msg); !errors.Is(err, sarama.ErrMessageSizeTooLarge) {
+		t.Errorf("produce error %v", err)
+	}
+}
+
+// newMockProducer returns a started Producer whose single worker writes to mp
+func newMockProducer(t *testing.T, mp sarama.AsyncProducer) *Producer {
+	p := &Producer{
+		numWorkers: 1,
+		queue:      make(chan *sarama.ProducerMessage, 10),
+	}
+	p.works = []*producerWorker{{producer: mp, queue: p.queue}}
+	p.Start()
+	return p
+}
+
+func TestProducerSendSync(t *testing.T) {
+	config := mocks.NewTestConfig()
+	config.Producer.Return.Successes = true
+	mp := mocks.NewAsyncProducer(t, config)
+	mp.ExpectInputAndSucceed()
+	mp.ExpectInputAndFail(sarama.ErrNotLeaderForPartition)
+	p := newMockProducer(t, mp)
+	defer p.Close()
+
+	msg := &sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("test_data"), Metadata: "meta"}
+	_, offset, err := p.SendSync(context.Background(), msg)
+	if err != nil || offset != 1 {
+		t.Errorf("offset %d err %v", offset, err)
+	}
+	if msg.Metadata != "meta" || msg.Offset != 0 {
+		t.Errorf("message changed by the producer: %v offset %d", msg.Metadata, msg.Offset)
+	}
+
+	report := <-p.SendAsync(context.Background(), &sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("test_data")})
+	if !errors.Is(report.Err, sarama.ErrNotLeaderForPartition) {
+		t.Errorf("report error %v", report.Err)
+	}
+}
+
+func TestProducerSendSyncTimeout(t *testing.T) {
+	mp := &stuckProducer{
+		input:     make(chan *sarama.ProducerMessage, 1),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+		release:   make(chan struct{}),
+	}
+	p := newMockProducer(t, mp)
+	defer func() {
+		close(mp.release)
+		p.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	msg := &sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("test_data"), Metadata: "meta"}
+	if _, _, err := p.SendSync(ctx, msg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err %v", err)
+	}
+	// the message is still in flight, the caller may reuse its own
+	if msg.Metadata != "meta" {
+		t.Errorf("metadata of the message in flight: %v", msg.Metadata)
+	}
+	msg.Metadata = "retry"
+}
+
+func TestProducerTuning(t *testing.T) {
+	options := &Options{}
+	for _, o := range []optFun{
+		WithCompression(sarama.CompressionZSTD),
+		WithCompressionLevel(3),
+		WithRequiredAcks(sarama.NoResponse),
+		WithFlush(50*time.Millisecond, 1<<20, 500, 1000),
+		WithMaxMessageBytes(2 << 20),
+		WithProducerRetry(0, time.Second),
+	} {
+		o(options)
+	}
+	c := sarama.NewConfig()
+	c.Version = sarama.V2_1_0_0
+	c.Producer.Compression = sarama.CompressionSnappy
+	options.tuning.apply(c)
+	if c.Producer.Compression != sarama.CompressionZSTD || c.Producer.CompressionLevel != 3 {
+		t.Errorf("compression %s level %d", c.Producer.Compression, c.Producer.CompressionLevel)
+	}
+	if c.Producer.RequiredAcks != sarama.NoResponse {
+		t.Errorf("acks %d", c.Producer.RequiredAcks)
+	}
+	if c.Producer.Flush.Frequency != 50*time.Millisecond || c.Producer.Flush.Bytes != 1<<20 ||
+		c.Producer.Flush.Messages != 500 || c.Producer.Flush.MaxMessages != 1000 {
+		t.Errorf("flush %+v", c.Producer.Flush)
+	}
+	if c.Producer.MaxMessageBytes != 2<<20 || c.Producer.Retry.Max != 0 || c.Producer.Retry.Backoff != time.Second {
+		t.Errorf("max bytes %d retry %d %s", c.Producer.MaxMessageBytes, c.Producer.Retry.Max, c.Producer.Retry.Backoff)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// unset options keep the defaults
+	c = sarama.NewConfig()
+	c.Producer.Compression = sarama.CompressionSnappy
+	(&producerTuning{}).apply(c)
+	if c.Producer.Compression != sarama.CompressionSnappy || c.Producer.RequiredAcks != sarama.WaitForLocal || c.Producer.Retry.Max != 3 {
+		t.Errorf("defaults changed: %s %d %d", c.Producer.Compression, c.Producer.RequiredAcks, c.Producer.Retry.Max)
+	}
+}
+
+func TestProducerIdempotent(t *testing.T) {
+	options := &Options{Name: "test"}
+	WithIdempotent(true)(options)
+	c, err := newProducerConfig(options, sarama.V2_1_0_0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Producer.Idempotent || c.Producer.RequiredAcks != sarama.WaitForAll || c.Net.MaxOpenRequests != 1 {
+		t.Errorf("idempotent %v acks %d max open requests %d", c.Producer.Idempotent, c.Producer.RequiredAcks, c.Net.MaxOpenRequests)
+	}
+	if err = c.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// conflicting tuning is applied afterwards and rejected by sarama
+	WithRequiredAcks(sarama.WaitForLocal)(options)
+	if c, err = newProducerConfig(options, sarama.V2_1_0_0); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Validate(); err == nil {
+		t.Error("idempotent producer validated without acks=all")
+	}
 }
@@ -0,0 +1,378 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWireFormat     = errors.New("message is not in the schema registry wire format")
+	ErrSchemaNotFound = errors.New("schema not found")
+)
+
+const (
+	wireMagic      = 0
+	wireHeaderSize = 5
+)
+
+// SchemaRegistry registers and looks up schemas by id
+type SchemaRegistry interface {
+	// Register returns the id of schema under subject, registering it when new
+	Register(subject, schema string) (int, error)
+	Schema(id int) (string, error)
+}
+
+// RegistryError is an error response of the schema registry
+type RegistryError struct {
+	Status  int
+	Code    int    `json:"error_code"`
+	Message string `json:"message"`
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("schema registry: %d %s", e.Code, e.Message)
+}
+
+func (e *RegistryError) Unwrap() error {
+	// 40403 schema not found, 40401 subject not found
+	if e.Code == 40403 || e.Code == 40401 || e.Status == http.StatusNotFound {
+		return ErrSchemaNotFound
+	}
+	return nil
+}
+
+// transientError is a schema lookup that failed on the network or with a 5xx
+// response, the message decoded with it is worth retrying
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// isTransientRegistryError reports whether a schema lookup may succeed later
+func isTransientRegistryError(err error) bool {
+	var regErr *RegistryError
+	if errors.As(err, &regErr) {
+		return regErr.Status >= http.StatusInternalServerError || regErr.Status == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, ErrSchemaNotFound)
+}
+
+// schemaCache keeps the ids and schemas already seen, they never change
+type schemaCache struct {
+	mu      sync.RWMutex
+	ids     map[string]int
+	schemas map[int]string
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{ids: make(map[string]int), schemas: make(map[int]string)}
+}
+
+func (c *schemaCache) id(subject, schema string) (int, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.ids[subject+"\x00"+schema]
+	return id, ok
+}
+
+func (c *schemaCache) schema(id int) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	schema, ok := c.schemas[id]
+	return schema, ok
+}
+
+func (c *schemaCache) add(subject, schema string, id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if subject != "" {
+		c.ids[subject+"\x00"+schema] = id
+	}
+	c.schemas[id] = schema
+}
+
+// HTTPRegistry is a client of the confluent schema registry rest api,
+// WithUser and WithPassword set the basic auth and the tls options apply
+type HTTPRegistry struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+	cache    *schemaCache
+}
+
+func NewHTTPRegistry(registryURL string, opts ...optFun) (*HTTPRegistry, error) {
+	options := &Options{}
+	for _, o := range opts {
+		o(options)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.tls.enable {
+		tc, err := newTLSClient(&options.tls)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tc.config
+		if tc.reloader != nil {
+			dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+			transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tc.dial(ctx, dialer, network, addr)
+			}
+		}
+	}
+	return &HTTPRegistry{
+		url:      strings.TrimRight(registryURL, "/"),
+		user:     options.user,
+		password: options.password,
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		cache:    newSchemaCache(),
+	}, nil
+}
+
+func (r *HTTPRegistry) Register(subject, schema string) (int, error) {
+	if id, ok := r.cache.id(subject, schema); ok {
+		return id, nil
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := r.do(http.MethodPost, "/subjects/"+url.PathEscape(subject)+"/versions", map[string]string{"schema": schema}, &resp); err != nil {
+		return 0, err
+	}
+	r.cache.add(subject, schema, resp.ID)
+	return resp.ID, nil
+}
+
+func (r *HTTPRegistry) Schema(id int) (string, error) {
+	if schema, ok := r.cache.schema(id); ok {
+		return schema, nil
+	}
+	var resp struct {
+		Schema string `json:"schema"`
+	}
+	if err := r.do(http.MethodGet, fmt.Sprintf("/schemas/ids/%d", id), nil, &resp); err != nil {
+		return "", err
+	}
+	r.cache.add("", resp.Schema, id)
+	return resp.Schema, nil
+}
+
+func (r *HTTPRegistry) do(method, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, r.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	}
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		regErr := &RegistryError{Status: resp.StatusCode}
+		if json.Unmarshal(data, regErr) != nil || regErr.Message == "" {
+			regErr.Code = resp.StatusCode
+			regErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return regErr
+	}
+	return json.Unmarshal(data, v)
+}
+
+// MemoryRegistry is an in memory SchemaRegistry for tests, ids start at 1
+// and a schema registered again keeps its id
+type MemoryRegistry struct {
+	mu       sync.Mutex
+	ids      map[string]int
+	schemas  map[int]string
+	subjects map[string][]int
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{ids: make(map[string]int), schemas: make(map[int]string), subjects: make(map[string][]int)}
+}
+
+func (r *MemoryRegistry) Register(subject, schema string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.ids[schema]
+	if !ok {
+		id = len(r.schemas) + 1
+		r.ids[schema] = id
+		r.schemas[id] = schema
+	}
+	for _, v := range r.subjects[subject] {
+		if v == id {
+			return id, nil
+		}
+	}
+	r.subjects[subject] = append(r.subjects[subject], id)
+	return id, nil
+}
+
+func (r *MemoryRegistry) Schema(id int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	schema, ok := r.schemas[id]
+	if !ok {
+		return "", ErrSchemaNotFound
+	}
+	return schema, nil
+}
+
+// Subjects returns the schema ids registered under subject in order
+func (r *MemoryRegistry) Subjects(subject string) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.subjects[subject]...)
+}
+
+// RegistryCodec is a Codec in the confluent wire format, a magic byte and the
+// big endian schema id before the payload encoded by the codec of the schema.
+// Values are encoded with the schema registered under subject, messages are
+// decoded with the schema of their id
+type RegistryCodec struct {
+	registry SchemaRegistry
+	subject  string
+	schema   string
+	newCodec func(schema string) (Codec, error)
+
+	mu     sync.RWMutex
+	id     int
+	codecs map[int]Codec
+}
+
+// NewRegistryCodec returns the codec of subject, schema may be empty for a
+// codec that only decodes
+func NewRegistryCodec(registry SchemaRegistry, subject, schema string, newCodec func(schema string) (Codec, error)) *RegistryCodec {
+	return &RegistryCodec{
+		registry: registry,
+		subject:  subject,
+		schema:   schema,
+		newCodec: newCodec,
+		codecs:   make(map[int]Codec),
+	}
+}
+
+// AvroSchemaCodec creates the AvroCodec of a registry schema
+func AvroSchemaCodec(schema string) (Codec, error) {
+	return NewAvroCodec(schema)
+}
+
+// JSONSchemaCodec creates a JSONCodec for registry json schemas, the schema is
+// not validated
+func JSONSchemaCodec(string) (Codec, error) {
+	return JSONCodec{}, nil
+}
+
+// TopicSubject is the default subject name of the message values of topic
+func TopicSubject(topic string) string {
+	return topic + "-value"
+}
+
+func (c *RegistryCodec) Encode(v interface{}) ([]byte, error) {
+	id, codec, err := c.writer()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, wireHeaderSize, wireHeaderSize+len(payload))
+	data[0] = wireMagic
+	binary.BigEndian.PutUint32(data[1:], uint32(id))
+	return append(data, payload...), nil
+}
+
+func (c *RegistryCodec) Decode(data []byte, v interface{}) error {
+	if len(data) < wireHeaderSize || data[0] != wireMagic {
+		return ErrWireFormat
+	}
+	codec, err := c.codec(int(binary.BigEndian.Uint32(data[1:wireHeaderSize])))
+	if err != nil {
+		return err
+	}
+	return codec.Decode(data[wireHeaderSize:], v)
+}
+
+// writer registers the schema on first use
+func (c *RegistryCodec) writer() (int, Codec, error) {
+	c.mu.RLock()
+	id := c.id
+	c.mu.RUnlock()
+	if id == 0 {
+		if c.schema == "" {
+			return 0, nil, fmt.Errorf("%w: no schema for subject %s", ErrSchemaNotFound, c.subject)
+		}
+		var err error
+		if id, err = c.registry.Register(c.subject, c.schema); err != nil {
+			return 0, nil, err
+		}
+		c.mu.Lock()
+		c.id = id
+		c.mu.Unlock()
+	}
+	codec, err := c.codec(id)
+	return id, codec, err
+}
+
+func (c *RegistryCodec) codec(id int) (Codec, error) {
+	c.mu.RLock()
+	codec, ok := c.codecs[id]
+	c.mu.RUnlock()
+	if ok {
+		return codec, nil
+	}
+	schema, err := c.registry.Schema(id)
+	if err != nil {
+		if isTransientRegistryError(err) {
+			return nil, &transientError{err: err}
+		}
+		return nil, err
+	}
+	if codec, err = c.newCodec(schema); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.codecs[id] = codec
+	c.mu.Unlock()
+	return codec, nil
+}
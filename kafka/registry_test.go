@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestRegistryCodec(t *testing.T) {
+	registry := NewMemoryRegistry()
+	codec := NewRegistryCodec(registry, TopicSubject("events"), testEventSchema, AvroSchemaCodec)
+	data, err := codec.Encode(&testEvent{ID: "a", Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0] != 0 || string(data[1:5]) != "\x00\x00\x00\x01" {
+		t.Errorf("wire header %x", data[:5])
+	}
+	if ids := registry.Subjects("events-value"); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("registered ids %v", ids)
+	}
+
+	// a decode only codec resolves the writer schema by id
+	reader := NewRegistryCodec(registry, "", "", AvroSchemaCodec)
+	var e testEvent
+	if err := reader.Decode(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "a" || e.Count != 2 {
+		t.Errorf("decoded %+v", e)
+	}
+	if _, err := reader.Encode(&e); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("encode without schema %v", err)
+	}
+	if err := reader.Decode([]byte(`{"id":"a"}`), &e); err != ErrWireFormat {
+		t.Errorf("wire format error %v", err)
+	}
+	if err := reader.Decode([]byte{0, 0, 0, 0, 9}, &e); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("unknown schema error %v", err)
+	}
+}
+
+func TestHTTPRegistry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if user, password, _ := r.BasicAuth(); user != "alice" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/subjects/events-value/versions":
+			var req map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req["schema"] != testEventSchema {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"error_code":42201,"message":"Invalid schema"}`))
+				return
+			}
+			w.Write([]byte(`{"id":7}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/schemas/ids/7":
+			json.NewEncoder(w).Encode(map[string]string{"schema": testEventSchema})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	registry, err := NewHTTPRegistry(server.URL+"/", WithUser("alice"), WithPassword("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if id, err := registry.Register("events-value", testEventSchema); err != nil || id != 7 {
+			t.Fatalf("register %d %v", id, err)
+		}
+		if schema, err := registry.Schema(7); err != nil || schema != testEventSchema {
+			t.Fatalf("schema %s %v", schema, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("registry calls %d, the registered schema must be cached", n)
+	}
+
+	_, err = registry.Schema(8)
+	var regErr *RegistryError
+	if !errors.As(err, &regErr) || regErr.Code != 40403 || !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("missing schema error %v", err)
+	}
+	if _, err = registry.Register("events-value", `"string"`); !errors.As(err, &regErr) || regErr.Code != 42201 {
+		t.Errorf("invalid schema error %v", err)
+	}
+
+	unauthorized, _ := NewHTTPRegistry(server.URL)
+	if _, err = unauthorized.Schema(7); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unauthorized error %v", err)
+	}
+}
+
+func TestRegistryUnavailable(t *testing.T) {
+	var status int32 = http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := int(atomic.LoadInt32(&status)); s != http.StatusOK {
+			w.WriteHeader(s)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"schema": testEventSchema})
+	}))
+	defer server.Close()
+	registry, err := NewHTTPRegistry(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewRegistryCodec(NewMemoryRegistry(), "events-value", testEventSchema, AvroSchemaCodec).Encode(&testEvent{ID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	process := NewTypedProcess(NewRegistryCodec(registry, "", "", AvroSchemaCodec), func() interface{} { return &testEvent{} },
+		func(*sarama.ConsumerMessage, interface{}) error {
+			calls++
+			return nil
+		})
+	msg := &sarama.ConsumerMessage{Topic: "events", Value: data}
+
+	// an outage is retried, an unknown schema is not
+	if err = process(msg); err == nil || IsPermanent(err) {
+		t.Errorf("registry outage error %v", err)
+	}
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	if err = process(msg); !IsPermanent(err) || !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("unknown schema error %v", err)
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err = process(msg); err != nil || calls != 1 {
+		t.Errorf("decoded after the outage: %v calls %d", err, calls)
+	}
+	server.Close()
+	// the schema is cached by the first registry
+	registry, _ = NewHTTPRegistry(server.URL)
+	var te *transientError
+	if err = NewRegistryCodec(registry, "", "", AvroSchemaCodec).Decode(data, &testEvent{}); !errors.As(err, &te) {
+		t.Errorf("network error %v", err)
+	}
+}
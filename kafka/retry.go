@@ -0,0 +1,95 @@
+package kafka
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how a consumer retries a message whose process
+// function failed before giving up on it
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one,
+	// a value <= 1 disables retry
+	MaxAttempts int
+	// InitialBackoff is the sleep before the first retry, doubled on every
+	// following retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the sleep between two attempts, 0 means no cap
+	MaxBackoff time.Duration
+	// Jitter randomises each sleep by up to this fraction (0 to 1)
+	Jitter float64
+	// Retryable reports whether err is worth retrying. When nil every error
+	// is retried except the ones wrapped by Permanent
+	Retryable func(err error) bool
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps err so the default retry classifier gives up on it at once
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was wrapped by Permanent
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+func (rp *RetryPolicy) retryable(err error, attempts int) bool {
+	if rp == nil || attempts >= rp.MaxAttempts {
+		return false
+	}
+	return rp.classify(err)
+}
+
+// classify reports whether err is worth retrying whatever the attempts made
+func (rp *RetryPolicy) classify(err error) bool {
+	if rp != nil && rp.Retryable != nil {
+		return rp.Retryable(err)
+	}
+	return !IsPermanent(err)
+}
+
+// backoff returns the sleep before the next attempt, attempts is the number
+// of attempts already made
+func (rp *RetryPolicy) backoff(attempts int) time.Duration {
+	d := rp.InitialBackoff
+	for i := 1; i < attempts; i++ {
+		// without MaxBackoff the doubling stops before it overflows, leaving
+		// room for the jitter
+		if d > math.MaxInt64/4 {
+			break
+		}
+		d *= 2
+		if rp.MaxBackoff > 0 && d >= rp.MaxBackoff {
+			break
+		}
+	}
+	if rp.MaxBackoff > 0 && d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if rp.Jitter > 0 && d > 0 {
+		j := rp.Jitter
+		if j > 1 {
+			j = 1
+		}
+		d = time.Duration(float64(d) * (1 - j + 2*j*rand.Float64()))
+	}
+	return d
+}
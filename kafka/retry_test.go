@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	rp := &RetryPolicy{MaxAttempts: 10, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if d := rp.backoff(i + 1); d != w*time.Millisecond {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, d, w*time.Millisecond)
+		}
+	}
+	rp.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := rp.backoff(1); d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatalf("jitter backoff out of range: %s", d)
+		}
+	}
+	// strict mode retries forever, the backoff must not wrap around
+	rp = &RetryPolicy{InitialBackoff: time.Millisecond, Jitter: 1}
+	for _, attempts := range []int{64, 1000, 1 << 30} {
+		if d := rp.backoff(attempts); d <= 0 {
+			t.Errorf("backoff(%d) = %s", attempts, d)
+		}
+	}
+}
+
+func TestRetryHandler(t *testing.T) {
+	calls := 0
+	options := &Options{retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}}
+	h := newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+		calls++
+		if calls < 3 {
+			return errors.New("timeout")
+		}
+		return nil
+	})
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test"}) || calls != 3 {
+		t.Errorf("calls %d", calls)
+	}
+
+	calls = 0
+	h = newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+		calls++
+		return Permanent(errors.New("bad message"))
+	})
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test"}) || calls != 1 {
+		t.Errorf("permanent error retried %d times", calls)
+	}
+}
+
+func TestRetryStop(t *testing.T) {
+	options := &Options{retry: &RetryPolicy{MaxAttempts: 100, InitialBackoff: time.Hour}}
+	h := newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+		return errors.New("timeout")
+	})
+	done := make(chan bool)
+	go func() {
+		done <- h.handle(nil, &sarama.ConsumerMessage{Topic: "test"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.stop()
+	select {
+	case marked := <-done:
+		if marked {
+			t.Error("interrupted message must not be marked")
+		}
+	case <-time.After(time.Second):
+		t.Error("stop did not interrupt retry")
+	}
+}
+
+func TestRetryStrict(t *testing.T) {
+	calls := 0
+	options := &Options{strict: true, retry: &RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Millisecond}}
+	h := newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+		calls++
+		if calls < 5 {
+			return errors.New("store down")
+		}
+		return nil
+	})
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test"}) || calls != 5 {
+		t.Errorf("strict mode gave up after %d calls", calls)
+	}
+
+	// a permanent error does not stall the partition
+	calls = 0
+	h = newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+		calls++
+		return Permanent(errors.New("bad payload"))
+	})
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test"}) || calls != 1 {
+		t.Errorf("strict mode retried a permanent error %d times", calls)
+	}
+
+	// an error the custom classifier marks fatal is not retried either
+	errFatal := errors.New("schema mismatch")
+	calls = 0
+	h = newMessageHandler(&Options{strict: true, retry: &RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Millisecond,
+		Retryable: func(err error) bool { return err != errFatal }}}, func(*sarama.ConsumerMessage) error {
+		calls++
+		if calls < 3 {
+			return errors.New("store down")
+		}
+		return errFatal
+	})
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test"}) || calls != 3 {
+		t.Errorf("strict mode stopped after %d calls, want 3", calls)
+	}
+
+	// the offset is marked once the dead-letter message is acknowledged
+	rp := newRecordProducer(3)
+	dlq := newMockProducer(t, rp)
+	defer dlq.Close()
+	h = newMessageHandler(&Options{strict: true, dlqTopic: "test-dlq", dlqProducer: dlq, retry: options.retry},
+		func(*sarama.ConsumerMessage) error {
+			return Permanent(errors.New("bad payload"))
+		})
+	if !h.handle(nil, &sarama.ConsumerMessage{Topic: "test"}) || len(rp.messages()) != 1 {
+		t.Errorf("dead-letter messages %d", len(rp.messages()))
+	}
+
+	done := make(chan struct{})
+	h = newMessageHandler(options, func(*sarama.ConsumerMessage) error {
+		return errors.New("store down")
+	})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+	}()
+	if h.handle(done, &sarama.ConsumerMessage{Topic: "test"}) {
+		t.Error("message must not be marked when the session ends")
+	}
+}
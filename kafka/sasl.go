@@ -0,0 +1,100 @@
+package kafka
+
+import (
+	"crypto/sha512"
+	"errors"
+	"hash"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// sasl mechanisms, SASLPlain is used when only user and password are set
+const (
+	SASLPlain       = sarama.SASLTypePlaintext
+	SASLScramSHA256 = sarama.SASLTypeSCRAMSHA256
+	SASLScramSHA512 = sarama.SASLTypeSCRAMSHA512
+	SASLOAuthBearer = sarama.SASLTypeOAuth
+)
+
+var (
+	ErrSASLMechanism     = errors.New("unsupported sasl mechanism")
+	ErrSASLTokenProvider = errors.New("sasl oauthbearer must set token provider")
+	ErrSASLUser          = errors.New("sasl must set user and password")
+)
+
+// TokenProviderFunc adapts a function to sarama.AccessTokenProvider, it is
+// called on every connection to the brokers so it may refresh the token
+type TokenProviderFunc func() (*sarama.AccessToken, error)
+
+func (f TokenProviderFunc) Token() (*sarama.AccessToken, error) {
+	return f()
+}
+
+// configureSASL applies the sasl options, nothing is enabled without user and mechanism
+func configureSASL(c *sarama.Config, o *Options) error {
+	mechanism := o.saslMechanism
+	if mechanism == "" {
+		if o.user == "" {
+			return nil
+		}
+		mechanism = SASLPlain
+	}
+	switch mechanism {
+	case SASLPlain:
+	case SASLScramSHA256:
+		c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA256}
+		}
+	case SASLScramSHA512:
+		c.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: sha512Hash}
+		}
+	case SASLOAuthBearer:
+		if o.tokenProvider == nil {
+			return ErrSASLTokenProvider
+		}
+		c.Net.SASL.TokenProvider = o.tokenProvider
+	default:
+		return ErrSASLMechanism
+	}
+	if mechanism != SASLOAuthBearer && (o.user == "" || o.password == "") {
+		return ErrSASLUser
+	}
+	c.Net.SASL.Enable = true
+	c.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+	c.Net.SASL.User = o.user
+	c.Net.SASL.Password = o.password
+	// oauthbearer is only carried by SaslAuthenticate requests, scram also
+	// runs over the v0 handshake of the brokers older than 1.0
+	if mechanism == SASLOAuthBearer || (mechanism != SASLPlain && c.Version.IsAtLeast(sarama.V1_0_0_0)) {
+		c.Net.SASL.Version = sarama.SASLHandshakeV1
+	}
+	return nil
+}
+
+// scram only ships sha1 and sha256
+var sha512Hash scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+
+// scramClient runs the client side of the scram exchange for sarama
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+func (s *scramClient) Begin(userName, password, authzID string) error {
+	client, err := s.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	s.conv = client.NewConversation()
+	return nil
+}
+
+func (s *scramClient) Step(challenge string) (string, error) {
+	return s.conv.Step(challenge)
+}
+
+func (s *scramClient) Done() bool {
+	return s.conv.Done()
+}
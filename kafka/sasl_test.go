@@ -0,0 +1,147 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// scramExchange plays the broker side of the scram exchange the way sarama
+// drives the client
+func scramExchange(client sarama.SCRAMClient, server *scram.ServerConversation, user, password string) error {
+	if err := client.Begin(user, password, ""); err != nil {
+		return err
+	}
+	msg, err := client.Step("")
+	if err != nil {
+		return err
+	}
+	for !client.Done() {
+		challenge, err := server.Step(msg)
+		if err != nil {
+			return err
+		}
+		if msg, err = client.Step(challenge); err != nil {
+			return err
+		}
+		if server.Done() && msg == "" {
+			break
+		}
+	}
+	if !server.Valid() {
+		return errors.New("server rejected client")
+	}
+	return nil
+}
+
+func newScramServer(t *testing.T, hash scram.HashGeneratorFcn, user, password string) *scram.Server {
+	client, err := hash.NewClient(user, password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := client.GetStoredCredentials(scram.KeyFactors{Salt: "kafka-salt", Iters: 4096})
+	server, err := hash.NewServer(func(name string) (scram.StoredCredentials, error) {
+		if name != user {
+			return scram.StoredCredentials{}, errors.New("unknown user")
+		}
+		return creds, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestSASLScram(t *testing.T) {
+	for _, tc := range []struct {
+		mechanism string
+		hash      scram.HashGeneratorFcn
+	}{
+		{SASLScramSHA256, scram.SHA256},
+		{SASLScramSHA512, sha512Hash},
+	} {
+		options := &Options{}
+		for _, o := range []optFun{WithUser("alice"), WithPassword("secret"), WithSASLMechanism(tc.mechanism)} {
+			o(options)
+		}
+		c := sarama.NewConfig()
+		c.Version = sarama.V2_0_0_0
+		if err := configureNet(c, options); err != nil {
+			t.Fatal(err)
+		}
+		if !c.Net.SASL.Enable || string(c.Net.SASL.Mechanism) != tc.mechanism || c.Net.SASL.Version != sarama.SASLHandshakeV1 {
+			t.Errorf("%s: sasl %v %s v%d", tc.mechanism, c.Net.SASL.Enable, c.Net.SASL.Mechanism, c.Net.SASL.Version)
+		}
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s: %v", tc.mechanism, err)
+		}
+
+		server := newScramServer(t, tc.hash, "alice", "secret")
+		if err := scramExchange(c.Net.SASL.SCRAMClientGeneratorFunc(), server.NewConversation(), "alice", "secret"); err != nil {
+			t.Errorf("%s: %v", tc.mechanism, err)
+		}
+		if err := scramExchange(c.Net.SASL.SCRAMClientGeneratorFunc(), server.NewConversation(), "alice", "wrong"); err == nil {
+			t.Errorf("%s: wrong password accepted", tc.mechanism)
+		}
+
+		// brokers older than 1.0 run scram over the v0 handshake
+		c = sarama.NewConfig()
+		c.Version = sarama.V0_10_2_0
+		if err := configureNet(c, options); err != nil {
+			t.Fatal(err)
+		}
+		if c.Net.SASL.Version != sarama.SASLHandshakeV0 {
+			t.Errorf("%s: handshake v%d on 0.10.2", tc.mechanism, c.Net.SASL.Version)
+		}
+		if err := c.Validate(); err != nil {
+			t.Errorf("%s: %v", tc.mechanism, err)
+		}
+	}
+}
+
+func TestSASLOAuthBearer(t *testing.T) {
+	calls := 0
+	provider := TokenProviderFunc(func() (*sarama.AccessToken, error) {
+		calls++
+		return &sarama.AccessToken{Token: "token"}, nil
+	})
+	options := &Options{}
+	WithSASLTokenProvider(provider)(options)
+	c := sarama.NewConfig()
+	c.Version = sarama.V2_0_0_0
+	if err := configureNet(c, options); err != nil {
+		t.Fatal(err)
+	}
+	if c.Net.SASL.Mechanism != sarama.SASLTypeOAuth || c.Net.SASL.TokenProvider == nil || c.Net.SASL.Version != sarama.SASLHandshakeV1 {
+		t.Fatalf("sasl mechanism %s", c.Net.SASL.Mechanism)
+	}
+	if token, err := c.Net.SASL.TokenProvider.Token(); err != nil || token.Token != "token" || calls != 1 {
+		t.Errorf("token %v %v", token, err)
+	}
+
+	if err := configureNet(sarama.NewConfig(), &Options{saslMechanism: SASLOAuthBearer}); err != ErrSASLTokenProvider {
+		t.Errorf("missing token provider error %v", err)
+	}
+	if err := configureNet(sarama.NewConfig(), &Options{saslMechanism: "GSSAPI", user: "u", password: "p"}); err != ErrSASLMechanism {
+		t.Errorf("unsupported mechanism error %v", err)
+	}
+	if err := configureNet(sarama.NewConfig(), &Options{saslMechanism: SASLScramSHA256, user: "u"}); err != ErrSASLUser {
+		t.Errorf("missing password error %v", err)
+	}
+}
+
+func TestSASLPlainDefault(t *testing.T) {
+	c := sarama.NewConfig()
+	if err := configureNet(c, &Options{user: "u", password: "p"}); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Net.SASL.Enable || c.Net.SASL.Mechanism != sarama.SASLTypePlaintext {
+		t.Errorf("sasl %v %s", c.Net.SASL.Enable, c.Net.SASL.Mechanism)
+	}
+	c = sarama.NewConfig()
+	if err := configureNet(c, &Options{}); err != nil || c.Net.SASL.Enable {
+		t.Errorf("sasl enabled without user: %v", err)
+	}
+}
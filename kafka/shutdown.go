@@ -0,0 +1,132 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/drivers"
+)
+
+var ErrLocalStoreClosed = errors.New("local store closed")
+
+// ShutdownReport counts what happened to the messages while the producer was
+// shutting down
+type ShutdownReport struct {
+	// Flushed messages were acknowledged by the broker
+	Flushed int
+	// Spilled messages failed or were not acknowledged in time and were
+	// written to the local store, they are sent again on the next start
+	Spilled int
+	// Lost messages were neither acknowledged nor persisted, it includes the
+	// SendAsync messages reported as failed to their sender
+	Lost int
+}
+
+// shutdownState is shared by the producer and its workers, it counts the
+// messages once the shutdown began and keeps the local store open while a
+// worker writes to it
+type shutdownState struct {
+	mu       sync.Mutex
+	draining bool
+	report   ShutdownReport
+	// expired is closed when the deadline of Shutdown passed, cause is the
+	// error of its context
+	expired chan struct{}
+	cause   error
+
+	storeMu     sync.RWMutex
+	storeClosed bool
+
+	// once runs the shutdown, the later calls return its result
+	once   sync.Once
+	result ShutdownReport
+	err    error
+}
+
+func newShutdownState() *shutdownState {
+	return &shutdownState{expired: make(chan struct{})}
+}
+
+func (s *shutdownState) count(flushed, spilled, lost int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		s.report.Flushed += flushed
+		s.report.Spilled += spilled
+		s.report.Lost += lost
+	}
+}
+
+func (s *shutdownState) writeToLocal(d *drivers.LocalStore, msg *sarama.ProducerMessage) error {
+	s.storeMu.RLock()
+	defer s.storeMu.RUnlock()
+	if s.storeClosed {
+		return ErrLocalStoreClosed
+	}
+	return producerWriteToLocal(d, msg)
+}
+
+// Shutdown stops the producer, it drains the queue and waits for the
+// acknowledgements until ctx is done. The messages failing meanwhile and the
+// ones still unacknowledged at the deadline are written to the local store
+// before it is closed. It returns ctx.Err() when the deadline passed, messages
+// acknowledged after it may then be sent twice. Shutdown and Close may be
+// called again, they return the report of the first call
+func (p *Producer) Shutdown(ctx context.Context) (ShutdownReport, error) {
+	s := p.state
+	s.once.Do(func() {
+		s.result, s.err = p.shutdown(ctx)
+	})
+	return s.result, s.err
+}
+
+func (p *Producer) shutdown(ctx context.Context) (ShutdownReport, error) {
+	s := p.state
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	if p.failover != nil {
+		p.failover.stop()
+	}
+	// the retry loop of the local store must not send to the closed queue
+	if p.localCache != nil {
+		p.localCache.Stop()
+	}
+	close(p.queue)
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.cause = err
+		close(s.expired)
+		for _, w := range p.works {
+			for _, msg := range w.abandon() {
+				w.persist(msg, err)
+			}
+		}
+		// the workers persist what is left in the queue, the sarama
+		// producers go on closing in the background
+		for _, w := range p.works {
+			<-w.drained
+		}
+	}
+
+	s.storeMu.Lock()
+	s.storeClosed = true
+	s.storeMu.Unlock()
+	if p.localCache != nil {
+		p.localCache.Close()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report, err
+}
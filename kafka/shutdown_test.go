@@ -0,0 +1,126 @@
+package kafka
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/jinglov/gomisc/drivers"
+)
+
+// stuckProducer never acknowledges and its Close blocks until release is closed
+type stuckProducer struct {
+	// the transaction methods are not called
+	sarama.AsyncProducer
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	release   chan struct{}
+}
+
+func (s *stuckProducer) AsyncClose() {}
+
+func (s *stuckProducer) Close() error {
+	<-s.release
+	close(s.successes)
+	close(s.errors)
+	return nil
+}
+
+func (s *stuckProducer) Input() chan<- *sarama.ProducerMessage     { return s.input }
+func (s *stuckProducer) Successes() <-chan *sarama.ProducerMessage { return s.successes }
+func (s *stuckProducer) Errors() <-chan *sarama.ProducerError      { return s.errors }
+
+// newStoreProducer returns a started Producer writing to mp and spilling to a
+// local store in path
+func newStoreProducer(t *testing.T, mp sarama.AsyncProducer, path string) *Producer {
+	p := &Producer{numWorkers: 1, queue: make(chan *sarama.ProducerMessage, 10)}
+	var err error
+	if p.localCache, err = drivers.NewLocalStore(path, p.Retry, 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	p.works = []*producerWorker{{producer: mp, queue: p.queue, localCache: p.localCache}}
+	p.Start()
+	return p
+}
+
+// stored returns the values persisted in the local store at path
+func stored(t *testing.T, path string) []string {
+	var values []string
+	store, err := drivers.NewLocalStore(path, func(topic string, data []byte) {
+		v, _ := decodeSpill(topic, data).Value.Encode()
+		values = append(values, string(v))
+	}, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.ProcessAll()
+	sort.Strings(values)
+	return values
+}
+
+func TestProducerShutdown(t *testing.T) {
+	path := t.TempDir()
+	config := mocks.NewTestConfig()
+	config.Producer.Return.Successes = true
+	mp := mocks.NewAsyncProducer(t, config)
+	mp.ExpectInputAndSucceed()
+	mp.ExpectInputAndFail(sarama.ErrNotLeaderForPartition)
+	mp.ExpectInputAndFail(sarama.ErrMessageSizeTooLarge)
+	p := newStoreProducer(t, mp, path)
+	p.Send("test", []byte("a"))
+	p.Send("test", []byte("b"))
+	p.Send("test", []byte("c"))
+
+	report, err := p.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report != (ShutdownReport{Flushed: 1, Spilled: 1, Lost: 1}) {
+		t.Errorf("report %+v", report)
+	}
+	if values := stored(t, path); len(values) != 1 || values[0] != "b" {
+		t.Errorf("stored %v", values)
+	}
+	// a deferred Close after Shutdown returns the first report
+	if again, err := p.Shutdown(context.Background()); err != nil || again != report {
+		t.Errorf("second shutdown %+v %v", again, err)
+	}
+	p.Close()
+}
+
+func TestProducerShutdownDeadline(t *testing.T) {
+	path := t.TempDir()
+	mp := &stuckProducer{
+		input:     make(chan *sarama.ProducerMessage, 1),
+		successes: make(chan *sarama.ProducerMessage),
+		errors:    make(chan *sarama.ProducerError),
+		release:   make(chan struct{}),
+	}
+	defer close(mp.release)
+	p := newStoreProducer(t, mp, path)
+	// a is taken by the sarama producer, b blocks the worker and c stays queued
+	p.Send("test", []byte("a"))
+	p.Send("test", []byte("b"))
+	report := p.SendAsync(context.Background(), &sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("c")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	shutdown, err := p.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("shutdown error %v", err)
+	}
+	if shutdown != (ShutdownReport{Spilled: 2, Lost: 1}) {
+		t.Errorf("report %+v", shutdown)
+	}
+	if r := <-report; r.Err != context.DeadlineExceeded {
+		t.Errorf("delivery report %v", r.Err)
+	}
+	if values := stored(t, path); len(values) != 2 || values[0] != "a" || values[1] != "b" {
+		t.Errorf("stored %v", values)
+	}
+}
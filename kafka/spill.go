@@ -0,0 +1,74 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// spillMagic prefixes the messages written to the local store, records
+// written before it hold the raw message value only
+var spillMagic = []byte{0, 'k', 'm', 1}
+
+// spillEnvelope is the local store format of a message
+type spillEnvelope struct {
+	Key       []byte        `json:"key,omitempty"`
+	Value     []byte        `json:"value,omitempty"`
+	Headers   []spillHeader `json:"headers,omitempty"`
+	Timestamp int64         `json:"timestamp,omitempty"`
+}
+
+type spillHeader struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func encodeSpill(msg *sarama.ProducerMessage) ([]byte, error) {
+	env := &spillEnvelope{}
+	var err error
+	if msg.Key != nil {
+		if env.Key, err = msg.Key.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Value != nil {
+		if env.Value, err = msg.Value.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	for _, h := range msg.Headers {
+		env.Headers = append(env.Headers, spillHeader{Key: h.Key, Value: h.Value})
+	}
+	if !msg.Timestamp.IsZero() {
+		env.Timestamp = msg.Timestamp.UnixNano()
+	}
+	b, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]byte, 0, len(spillMagic)+len(b)), spillMagic...), b...), nil
+}
+
+// decodeSpill rebuilds a message read from the local store, legacy records
+// and records failing to decode are replayed as a raw value
+func decodeSpill(topic string, data []byte) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{Topic: topic}
+	env := &spillEnvelope{}
+	if !bytes.HasPrefix(data, spillMagic) || json.Unmarshal(data[len(spillMagic):], env) != nil {
+		msg.Value = sarama.ByteEncoder(data)
+		return msg
+	}
+	if env.Key != nil {
+		msg.Key = sarama.ByteEncoder(env.Key)
+	}
+	msg.Value = sarama.ByteEncoder(env.Value)
+	for _, h := range env.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: h.Key, Value: h.Value})
+	}
+	if env.Timestamp != 0 {
+		msg.Timestamp = time.Unix(0, env.Timestamp)
+	}
+	return msg
+}
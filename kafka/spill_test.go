@@ -0,0 +1,61 @@
+package kafka
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/drivers"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestSpillLocalStore(t *testing.T) {
+	path := t.TempDir()
+	// a record written by the old format holding the raw value only
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := []byte("legacy_data")
+	if err = db.Put(append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, "test"...), []byte(base64.StdEncoding.EncodeToString(legacy)), nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	p := &Producer{queue: make(chan *sarama.ProducerMessage, 10)}
+	p.localCache, err = drivers.NewLocalStore(path, p.Retry, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.localCache.Close()
+	ts := time.Unix(1600000000, 0)
+	err = producerWriteToLocal(p.localCache, &sarama.ProducerMessage{
+		Topic:     "test",
+		Key:       sarama.StringEncoder("key"),
+		Value:     sarama.StringEncoder("test_data"),
+		Headers:   []sarama.RecordHeader{{Key: []byte("h"), Value: []byte("v")}},
+		Timestamp: ts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.localCache.ProcessAll()
+
+	msg := <-p.queue
+	if v, _ := msg.Value.Encode(); string(v) != "legacy_data" || msg.Key != nil {
+		t.Errorf("legacy record replayed as %q", v)
+	}
+	msg = <-p.queue
+	k, _ := msg.Key.Encode()
+	v, _ := msg.Value.Encode()
+	if msg.Topic != "test" || string(k) != "key" || string(v) != "test_data" {
+		t.Errorf("replayed %s %q %q", msg.Topic, k, v)
+	}
+	if len(msg.Headers) != 1 || string(msg.Headers[0].Key) != "h" || string(msg.Headers[0].Value) != "v" {
+		t.Errorf("headers %v", msg.Headers)
+	}
+	if !msg.Timestamp.Equal(ts) {
+		t.Errorf("timestamp %s", msg.Timestamp)
+	}
+}
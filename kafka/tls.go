@@ -0,0 +1,234 @@
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTLSCA         = errors.New("tls ca contains no certificate")
+	ErrTLSServerName = errors.New("tls server name unknown")
+)
+
+type tlsOptions struct {
+	enable             bool
+	caFile             string
+	caPEM              []byte
+	certFile           string
+	keyFile            string
+	certPEM            []byte
+	keyPEM             []byte
+	serverName         string
+	insecureSkipVerify bool
+}
+
+// tlsClient holds the client tls config, with a ca file the server chain is
+// verified by reloader against the server name or the dialed host
+type tlsClient struct {
+	config   *tls.Config
+	reloader *certReloader
+}
+
+// newTLSClient builds the client tls config. Certificates given as files are
+// reloaded on handshake once the files changed on disk
+func newTLSClient(o *tlsOptions) (*tlsClient, error) {
+	c, r, err := newTLSConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tlsClient{config: c}
+	if c.VerifyConnection != nil {
+		tc.reloader = r
+	}
+	return tc, nil
+}
+
+// forHost returns the config of a connection to host, host is verified when
+// no server name is set
+func (tc *tlsClient) forHost(host string) *tls.Config {
+	c := tc.config.Clone()
+	if c.ServerName == "" {
+		c.ServerName = host
+	}
+	if tc.reloader != nil {
+		c.VerifyConnection = tc.reloader.verifier(c.ServerName)
+	}
+	return c
+}
+
+// dial opens a tls connection to addr and runs the handshake before ctx is done
+func (tc *tlsClient) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tc.forHost(host))
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func newTLSConfig(o *tlsOptions) (*tls.Config, *certReloader, error) {
+	c := &tls.Config{
+		ServerName:         o.serverName,
+		InsecureSkipVerify: o.insecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if len(o.caPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(o.caPEM) {
+			return nil, nil, ErrTLSCA
+		}
+		c.RootCAs = pool
+	}
+	if len(o.certPEM) > 0 || len(o.keyPEM) > 0 {
+		cert, err := tls.X509KeyPair(o.certPEM, o.keyPEM)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if o.caFile == "" && o.certFile == "" {
+		return c, nil, nil
+	}
+	r := &certReloader{caFile: o.caFile, certFile: o.certFile, keyFile: o.keyFile}
+	if err := r.reload(); err != nil {
+		return nil, nil, err
+	}
+	if o.certFile != "" {
+		c.GetClientCertificate = r.clientCertificate
+	}
+	if o.caFile != "" && !o.insecureSkipVerify {
+		// the default verification can not see a rotated ca, verify the
+		// chain ourselves against the current pool instead. The handshake
+		// does not tell the dialed host, forHost verifies it
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = r.verifier(o.serverName)
+	}
+	return c, r, nil
+}
+
+// certReloader holds the certificates loaded from files
+type certReloader struct {
+	mu       sync.Mutex
+	caFile   string
+	certFile string
+	keyFile  string
+	caMod    time.Time
+	certMod  time.Time
+	pool     *x509.CertPool
+	cert     *tls.Certificate
+}
+
+// reload loads the files changed since the last load, on error the
+// previous certificates are kept
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.caFile != "" {
+		mod, err := modTime(r.caFile)
+		if err != nil {
+			return err
+		}
+		if !mod.Equal(r.caMod) {
+			b, err := ioutil.ReadFile(r.caFile)
+			if err != nil {
+				return err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				return ErrTLSCA
+			}
+			r.pool, r.caMod = pool, mod
+		}
+	}
+	if r.certFile != "" {
+		mod, err := modTime(r.certFile)
+		if err != nil {
+			return err
+		}
+		keyMod, err := modTime(r.keyFile)
+		if err != nil {
+			return err
+		}
+		if keyMod.After(mod) {
+			mod = keyMod
+		}
+		if !mod.Equal(r.certMod) {
+			cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+			if err != nil {
+				return err
+			}
+			r.cert, r.certMod = &cert, mod
+		}
+	}
+	return nil
+}
+
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_ = r.reload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// verifier verifies the server chain and its name, serverName falls back to
+// the SNI name which is empty for hosts given as ip
+func (r *certReloader) verifier(serverName string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		name := serverName
+		if name == "" {
+			name = cs.ServerName
+		}
+		return r.verifyConnection(cs, name)
+	}
+}
+
+func (r *certReloader) verifyConnection(cs tls.ConnectionState, serverName string) error {
+	_ = r.reload()
+	r.mu.Lock()
+	pool := r.pool
+	r.mu.Unlock()
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls server sent no certificate")
+	}
+	if serverName == "" {
+		return ErrTLSServerName
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
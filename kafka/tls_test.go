@@ -0,0 +1,298 @@
+package kafka
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{cn}
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// handshake runs a tls handshake between the client config and a broker
+// serving server, the broker requires a client certificate signed by ca
+func handshake(t *testing.T, client *tls.Config, server *testCert, ca *testCert) (*x509.Certificate, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	sc := &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	cc, sconn := net.Pipe()
+	defer cc.Close()
+	defer sconn.Close()
+	peer := make(chan *x509.Certificate, 1)
+	go func() {
+		s := tls.Server(sconn, sc)
+		if s.Handshake() == nil {
+			peer <- s.ConnectionState().PeerCertificates[0]
+		}
+		close(peer)
+		s.Close()
+	}()
+	c := tls.Client(cc, client)
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return <-peer, nil
+}
+
+func TestTLSPEM(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	broker := newTestCert(t, "broker", ca)
+	client := newTestCert(t, "client", ca)
+
+	options := &Options{}
+	for _, o := range []optFun{
+		WithTLSCAPEM(ca.certPEM),
+		WithTLSClientCertPEM(client.certPEM, client.keyPEM),
+		WithTLSServerName("broker"),
+	} {
+		o(options)
+	}
+	if !options.tls.enable {
+		t.Fatal("tls not enabled")
+	}
+	tc, err := newTLSClient(&options.tls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tc.config
+	peer, err := handshake(t, c, broker, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Subject.CommonName != "client" {
+		t.Errorf("client certificate %s", peer.Subject.CommonName)
+	}
+
+	// broker signed by another ca must be rejected
+	other := newTestCert(t, "other", nil)
+	if _, err = handshake(t, c, newTestCert(t, "broker", other), ca); err == nil {
+		t.Error("untrusted broker accepted")
+	}
+
+	if _, err = newTLSClient(&tlsOptions{caPEM: []byte("garbage")}); err != ErrTLSCA {
+		t.Errorf("bad ca error %v", err)
+	}
+}
+
+func TestTLSFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte, mod time.Time) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	ca := newTestCert(t, "ca", nil)
+	broker := newTestCert(t, "broker", ca)
+	client := newTestCert(t, "client", ca)
+	mod := time.Now().Add(-time.Minute)
+	caFile := write("ca.pem", ca.certPEM, mod)
+	certFile := write("client.pem", client.certPEM, mod)
+	keyFile := write("client.key", client.keyPEM, mod)
+
+	tc, err := newTLSClient(&tlsOptions{
+		enable:     true,
+		caFile:     caFile,
+		certFile:   certFile,
+		keyFile:    keyFile,
+		serverName: "broker",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tc.config
+	peer, err := handshake(t, c, broker, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Subject.CommonName != "client" {
+		t.Errorf("client certificate %s", peer.Subject.CommonName)
+	}
+
+	// rotate the ca, broker and client certificates
+	ca2 := newTestCert(t, "ca", nil)
+	broker2 := newTestCert(t, "broker", ca2)
+	client2 := newTestCert(t, "rotated", ca2)
+	mod = time.Now()
+	write("ca.pem", ca2.certPEM, mod)
+	write("client.pem", client2.certPEM, mod)
+	write("client.key", client2.keyPEM, mod)
+
+	peer, err = handshake(t, c, broker2, ca2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Subject.CommonName != "rotated" {
+		t.Errorf("client certificate not reloaded: %s", peer.Subject.CommonName)
+	}
+	if _, err = handshake(t, c, broker, ca); err == nil {
+		t.Error("broker signed by the old ca accepted")
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafka-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	client := newTestCert(t, "client", ca)
+	files := make(map[string]string)
+	for name, data := range map[string][]byte{"ca.pem": ca.certPEM, "client.pem": client.certPEM, "client.key": client.keyPEM} {
+		files[name] = filepath.Join(dir, name)
+		if err = ioutil.WriteFile(files[name], data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newClient := func(serverName string) *tlsClient {
+		tc, err := newTLSClient(&tlsOptions{
+			enable:     true,
+			caFile:     files["ca.pem"],
+			certFile:   files["client.pem"],
+			keyFile:    files["client.key"],
+			serverName: serverName,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tc
+	}
+
+	// a certificate signed by the ca for another host is rejected
+	broker := newTestCert(t, "broker", ca)
+	if _, err = handshake(t, newClient("other").config, broker, ca); err == nil {
+		t.Error("certificate with a mismatched name accepted")
+	}
+	tc := newClient("")
+	if _, err = handshake(t, tc.forHost("127.0.0.1"), broker, ca); err == nil {
+		t.Error("certificate with a mismatched ip accepted")
+	}
+	if _, err = handshake(t, tc.config, broker, ca); err == nil {
+		t.Error("certificate accepted without server name")
+	}
+	if _, err = handshake(t, tc.forHost("broker"), broker, ca); err != nil {
+		t.Errorf("dialed host: %v", err)
+	}
+	if _, err = handshake(t, tc.forHost("127.0.0.1"), newTestCert(t, "127.0.0.1", ca), ca); err != nil {
+		t.Errorf("dialed ip: %v", err)
+	}
+
+	// the dialer verifies the host of the dialed address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serve := func(server *testCert) {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		s := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{server.tlsCertificate(t)}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool})
+		_ = s.Handshake()
+		s.Close()
+	}
+	c := sarama.NewConfig()
+	if err = configureNet(c, &Options{tls: tlsOptions{enable: true, caFile: files["ca.pem"], certFile: files["client.pem"], keyFile: files["client.key"]}}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Net.TLS.Enable || !c.Net.Proxy.Enable {
+		t.Fatal("tls is not dialed by the tls dialer")
+	}
+	go serve(broker)
+	if conn, err := c.Net.Proxy.Dialer.Dial("tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("dialer accepted a certificate without the dialed ip")
+	}
+	go serve(newTestCert(t, "127.0.0.1", ca))
+	conn, err := c.Net.Proxy.Dialer.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
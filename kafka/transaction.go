@@ -0,0 +1,505 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/logger"
+)
+
+var (
+	ErrTxnNotBegun   = errors.New("transaction not begun")
+	ErrTxnInProgress = errors.New("transaction already in progress")
+	ErrTxnVersion    = errors.New("transactional producer requires kafka version >= 0.11")
+)
+
+// TransactionalProducer writes messages and consumer offsets atomically in
+// Kafka transactions. Messages sent within a transaction are buffered and
+// written to the brokers on Commit, read-committed consumers only see them
+// once the transaction is committed
+type TransactionalProducer struct {
+	client          sarama.Client
+	config          *sarama.Config
+	transactionalID string
+	timeout         time.Duration
+	producerID      int64
+	producerEpoch   int16
+	coordinator     *sarama.Broker
+	partitioners    map[string]sarama.Partitioner
+	sequences       map[topicPartition]int32
+	mu              sync.Mutex
+	idle            *sync.Cond // broadcast when ending or adding changes
+	inTxn           bool
+	ending          bool // Commit or Abort is running
+	adding          int  // running SendOffsetsToTransaction calls
+	pending         map[topicPartition][]*sarama.ProducerMessage
+	added           bool
+	log             logger.Logi
+}
+
+func NewTransactionalProducer(transactionalID, version string, brokers []string, opts ...optFun) (*TransactionalProducer, error) {
+	options := &Options{
+		Name:    transactionalID,
+		brokers: brokers,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+	if len(options.brokers) == 0 {
+		return nil, ErrBrokers
+	}
+	v := kafkaVersion(version)
+	if !v.IsAtLeast(sarama.V0_11_0_0) {
+		return nil, ErrTxnVersion
+	}
+	// the batches are written with the producer codec and retry settings
+	c, err := newProducerConfig(options, v)
+	if err != nil {
+		return nil, err
+	}
+	c.ClientID = transactionalID
+	client, err := sarama.NewClient(options.brokers, c)
+	if err != nil {
+		return nil, err
+	}
+	tp := &TransactionalProducer{
+		client:          client,
+		config:          c,
+		transactionalID: transactionalID,
+		timeout:         options.txnTimeout,
+		partitioners:    make(map[string]sarama.Partitioner),
+		log:             options.log,
+	}
+	tp.idle = sync.NewCond(&tp.mu)
+	if tp.timeout <= 0 {
+		tp.timeout = time.Minute
+	}
+	tp.mu.Lock()
+	err = tp.initProducerID()
+	tp.mu.Unlock()
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return tp, nil
+}
+
+// initProducerID fences previous producers using the same transactional id
+// and gets the producer id and epoch of this one
+func (tp *TransactionalProducer) initProducerID() error {
+	req := &sarama.InitProducerIDRequest{TransactionalID: &tp.transactionalID, TransactionTimeout: tp.timeout}
+	return tp.retryCoordinator(func(b *sarama.Broker) (sarama.KError, error) {
+		res, err := b.InitProducerID(req)
+		if err != nil {
+			return sarama.ErrNoError, err
+		}
+		if res.Err == sarama.ErrNoError {
+			tp.producerID = res.ProducerID
+			tp.producerEpoch = res.ProducerEpoch
+			tp.sequences = make(map[topicPartition]int32)
+		}
+		return res.Err, nil
+	})
+}
+
+// Begin starts a transaction
+func (tp *TransactionalProducer) Begin() error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.inTxn || tp.ending {
+		return ErrTxnInProgress
+	}
+	tp.inTxn = true
+	tp.added = false
+	tp.pending = make(map[topicPartition][]*sarama.ProducerMessage)
+	return nil
+}
+
+// Send adds msg to the current transaction
+func (tp *TransactionalProducer) Send(msg *sarama.ProducerMessage) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if !tp.inTxn {
+		return ErrTxnNotBegun
+	}
+	partition, err := tp.partition(msg)
+	if err != nil {
+		return err
+	}
+	msg.Partition = partition
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	key := topicPartition{topic: msg.Topic, partition: partition}
+	tp.pending[key] = append(tp.pending[key], msg)
+	return nil
+}
+
+func (tp *TransactionalProducer) partition(msg *sarama.ProducerMessage) (int32, error) {
+	p, ok := tp.partitioners[msg.Topic]
+	if !ok {
+		p = tp.config.Producer.Partitioner(msg.Topic)
+		tp.partitioners[msg.Topic] = p
+	}
+	var partitions []int32
+	var err error
+	if p.RequiresConsistency() {
+		partitions, err = tp.client.Partitions(msg.Topic)
+	} else {
+		partitions, err = tp.client.WritablePartitions(msg.Topic)
+	}
+	if err != nil {
+		return -1, err
+	}
+	if len(partitions) == 0 {
+		return -1, sarama.ErrLeaderNotAvailable
+	}
+	choice, err := p.Partition(msg, int32(len(partitions)))
+	if err != nil {
+		return -1, err
+	}
+	if choice < 0 || int(choice) >= len(partitions) {
+		return -1, sarama.ErrInvalidPartition
+	}
+	return partitions[choice], nil
+}
+
+// SendOffsetsToTransaction commits the consumer group offsets as part of the
+// current transaction, offsets are the next offsets to consume
+func (tp *TransactionalProducer) SendOffsetsToTransaction(offsets map[string][]*sarama.PartitionOffsetMetadata, groupID string) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if !tp.inTxn {
+		return ErrTxnNotBegun
+	}
+	tp.added = true
+	// Commit and Abort wait for the offsets to be added
+	tp.adding++
+	defer func() {
+		tp.adding--
+		tp.idle.Broadcast()
+	}()
+	err := tp.retryCoordinator(func(b *sarama.Broker) (sarama.KError, error) {
+		res, err := b.AddOffsetsToTxn(&sarama.AddOffsetsToTxnRequest{
+			TransactionalID: tp.transactionalID,
+			ProducerID:      tp.producerID,
+			ProducerEpoch:   tp.producerEpoch,
+			GroupID:         groupID,
+		})
+		if err != nil {
+			return sarama.ErrNoError, err
+		}
+		return res.Err, nil
+	})
+	if err != nil {
+		return err
+	}
+	groupCoordinator, err := tp.client.Coordinator(groupID)
+	if err != nil {
+		return err
+	}
+	res, err := groupCoordinator.TxnOffsetCommit(&sarama.TxnOffsetCommitRequest{
+		TransactionalID: tp.transactionalID,
+		GroupID:         groupID,
+		ProducerID:      tp.producerID,
+		ProducerEpoch:   tp.producerEpoch,
+		Topics:          offsets,
+	})
+	if err != nil {
+		return err
+	}
+	for topic, errs := range res.Topics {
+		for _, pe := range errs {
+			if pe.Err != sarama.ErrNoError {
+				return fmt.Errorf("txn offset commit %s/%d: %w", topic, pe.Partition, pe.Err)
+			}
+		}
+	}
+	return nil
+}
+
+// Commit writes the buffered messages and commits the transaction, the
+// transaction is aborted if the messages fail to be written
+func (tp *TransactionalProducer) Commit() error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	pending, err := tp.end()
+	if err != nil {
+		return err
+	}
+	defer tp.ended()
+	if err = tp.flush(pending); err != nil {
+		if e := tp.endTxn(false); e != nil && tp.log != nil {
+			tp.log.Errorf("failed to abort transaction %s: %s", tp.transactionalID, e.Error())
+		}
+		// the sequences of the failed batches are unknown, a new epoch
+		// starts them over, the next flush retries a failed reset
+		tp.sequences = nil
+		if e := tp.initProducerID(); e != nil && tp.log != nil {
+			tp.log.Errorf("failed to reset producer id of transaction %s: %s", tp.transactionalID, e.Error())
+		}
+		return err
+	}
+	return tp.endTxn(true)
+}
+
+// Abort drops the buffered messages and aborts the transaction
+func (tp *TransactionalProducer) Abort() error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if _, err := tp.end(); err != nil {
+		return err
+	}
+	defer tp.ended()
+	return tp.endTxn(false)
+}
+
+// end takes the buffered messages of the transaction being ended once the
+// offsets being added are
+func (tp *TransactionalProducer) end() (map[topicPartition][]*sarama.ProducerMessage, error) {
+	if !tp.inTxn {
+		return nil, ErrTxnNotBegun
+	}
+	tp.inTxn = false
+	tp.ending = true
+	for tp.adding > 0 {
+		tp.idle.Wait()
+	}
+	pending := tp.pending
+	tp.pending = nil
+	return pending, nil
+}
+
+func (tp *TransactionalProducer) ended() {
+	tp.ending = false
+	tp.idle.Broadcast()
+}
+
+func (tp *TransactionalProducer) Close() error {
+	return tp.client.Close()
+}
+
+func (tp *TransactionalProducer) endTxn(commit bool) error {
+	if !tp.added {
+		return nil
+	}
+	return tp.retryCoordinator(func(b *sarama.Broker) (sarama.KError, error) {
+		res, err := b.EndTxn(&sarama.EndTxnRequest{
+			TransactionalID:   tp.transactionalID,
+			ProducerID:        tp.producerID,
+			ProducerEpoch:     tp.producerEpoch,
+			TransactionResult: commit,
+		})
+		if err != nil {
+			return sarama.ErrNoError, err
+		}
+		return res.Err, nil
+	})
+}
+
+// flush adds the pending partitions to the transaction and writes one record
+// batch per partition to its leader
+func (tp *TransactionalProducer) flush(pending map[topicPartition][]*sarama.ProducerMessage) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	if tp.sequences == nil {
+		if err := tp.initProducerID(); err != nil {
+			return err
+		}
+	}
+	partitions := make(map[string][]int32)
+	for key := range pending {
+		partitions[key.topic] = append(partitions[key.topic], key.partition)
+	}
+	tp.added = true
+	err := tp.retryCoordinator(func(b *sarama.Broker) (sarama.KError, error) {
+		res, err := b.AddPartitionsToTxn(&sarama.AddPartitionsToTxnRequest{
+			TransactionalID: tp.transactionalID,
+			ProducerID:      tp.producerID,
+			ProducerEpoch:   tp.producerEpoch,
+			TopicPartitions: partitions,
+		})
+		if err != nil {
+			return sarama.ErrNoError, err
+		}
+		for _, errs := range res.Errors {
+			for _, pe := range errs {
+				if pe.Err != sarama.ErrNoError {
+					return pe.Err, nil
+				}
+			}
+		}
+		return sarama.ErrNoError, nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, msgs := range pending {
+		if err = tp.produce(key, msgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tp *TransactionalProducer) produce(key topicPartition, msgs []*sarama.ProducerMessage) error {
+	leader, err := tp.client.Leader(key.topic, key.partition)
+	if err != nil {
+		return err
+	}
+	batch := &sarama.RecordBatch{
+		Version:          2,
+		Codec:            tp.config.Producer.Compression,
+		CompressionLevel: tp.config.Producer.CompressionLevel,
+		FirstTimestamp:   msgs[0].Timestamp,
+		MaxTimestamp:     msgs[0].Timestamp,
+		ProducerID:       tp.producerID,
+		ProducerEpoch:    tp.producerEpoch,
+		FirstSequence:    tp.sequences[key],
+		IsTransactional:  true,
+		LastOffsetDelta:  int32(len(msgs) - 1),
+	}
+	for i, msg := range msgs {
+		r := &sarama.Record{OffsetDelta: int64(i), TimestampDelta: msg.Timestamp.Sub(batch.FirstTimestamp)}
+		if msg.Key != nil {
+			if r.Key, err = msg.Key.Encode(); err != nil {
+				return err
+			}
+		}
+		if msg.Value != nil {
+			if r.Value, err = msg.Value.Encode(); err != nil {
+				return err
+			}
+		}
+		for j := range msg.Headers {
+			r.Headers = append(r.Headers, &msg.Headers[j])
+		}
+		if msg.Timestamp.After(batch.MaxTimestamp) {
+			batch.MaxTimestamp = msg.Timestamp
+		}
+		batch.Records = append(batch.Records, r)
+	}
+	req := &sarama.ProduceRequest{
+		TransactionalID: &tp.transactionalID,
+		RequiredAcks:    sarama.WaitForAll,
+		Timeout:         int32(tp.config.Producer.Timeout / time.Millisecond),
+		Version:         3,
+	}
+	if tp.config.Producer.Compression == sarama.CompressionZSTD {
+		req.Version = 7
+	}
+	req.AddBatch(key.topic, key.partition, batch)
+	res, err := leader.Produce(req)
+	if err != nil {
+		return err
+	}
+	block := res.GetBlock(key.topic, key.partition)
+	if block == nil {
+		return sarama.ErrIncompleteResponse
+	}
+	if block.Err != sarama.ErrNoError {
+		return fmt.Errorf("produce %s/%d: %w", key.topic, key.partition, block.Err)
+	}
+	tp.sequences[key] += int32(len(msgs))
+	for _, msg := range msgs {
+		msg.Offset = block.Offset
+		block.Offset++
+	}
+	return nil
+}
+
+// retryCoordinator sends a request to the transaction coordinator, looking it
+// up again and retrying when the coordinator moved or is busy. It is called
+// with tp.mu held, the lock is released while backing off
+func (tp *TransactionalProducer) retryCoordinator(fn func(*sarama.Broker) (sarama.KError, error)) error {
+	var err error
+	for attempt := 0; attempt <= tp.config.Producer.Retry.Max; attempt++ {
+		if attempt > 0 {
+			tp.mu.Unlock()
+			time.Sleep(tp.config.Producer.Retry.Backoff)
+			tp.mu.Lock()
+		}
+		if tp.coordinator == nil {
+			if tp.coordinator, err = tp.findCoordinator(); err != nil {
+				continue
+			}
+		}
+		var kerr sarama.KError
+		kerr, err = fn(tp.coordinator)
+		if err != nil {
+			tp.coordinator = nil
+			continue
+		}
+		switch kerr {
+		case sarama.ErrNoError:
+			return nil
+		case sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable:
+			tp.coordinator = nil
+			err = kerr
+		case sarama.ErrOffsetsLoadInProgress, sarama.ErrConcurrentTransactions:
+			err = kerr
+		default:
+			return kerr
+		}
+	}
+	return err
+}
+
+func (tp *TransactionalProducer) findCoordinator() (*sarama.Broker, error) {
+	var err error
+	for _, b := range tp.client.Brokers() {
+		if e := b.Open(tp.config); e != nil && e != sarama.ErrAlreadyConnected {
+			err = e
+			continue
+		}
+		var res *sarama.FindCoordinatorResponse
+		res, err = b.FindCoordinator(&sarama.FindCoordinatorRequest{
+			Version:         1,
+			CoordinatorKey:  tp.transactionalID,
+			CoordinatorType: sarama.CoordinatorTransaction,
+		})
+		if err != nil {
+			continue
+		}
+		if res.Err != sarama.ErrNoError {
+			err = res.Err
+			continue
+		}
+		coordinator, e := tp.poolBroker(res.Coordinator.Addr())
+		if e != nil {
+			err = e
+			continue
+		}
+		return coordinator, nil
+	}
+	if err == nil {
+		err = sarama.ErrOutOfBrokers
+	}
+	return nil, err
+}
+
+// poolBroker returns the connected client broker at addr, the coordinator is
+// taken from the client pool so it is closed with the client
+func (tp *TransactionalProducer) poolBroker(addr string) (*sarama.Broker, error) {
+	for refreshed := false; ; refreshed = true {
+		for _, b := range tp.client.Brokers() {
+			if b.Addr() != addr {
+				continue
+			}
+			if err := b.Open(tp.config); err != nil && err != sarama.ErrAlreadyConnected {
+				return nil, err
+			}
+			return b, nil
+		}
+		if refreshed {
+			return nil, sarama.ErrBrokerNotFound
+		}
+		if err := tp.client.RefreshMetadata(); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// txnHandlers answers the requests of a transaction coordinated by broker,
+// the transaction coordinator is looked up with version 1, the group one
+// with version 0
+func txnHandlers(t *testing.T, broker *sarama.MockBroker) map[string]sarama.MockResponse {
+	return map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("test", 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockSequence(
+			&sarama.FindCoordinatorResponse{Version: 1, Coordinator: sarama.NewBroker(broker.Addr())},
+			sarama.NewMockFindCoordinatorResponse(t).SetCoordinator(sarama.CoordinatorGroup, "test-group", broker),
+		),
+		"InitProducerIDRequest":     sarama.NewMockWrapper(&sarama.InitProducerIDResponse{ProducerID: 7, ProducerEpoch: 1}),
+		"AddPartitionsToTxnRequest": sarama.NewMockWrapper(&sarama.AddPartitionsToTxnResponse{}),
+		"AddOffsetsToTxnRequest":    sarama.NewMockWrapper(&sarama.AddOffsetsToTxnResponse{}),
+		"TxnOffsetCommitRequest":    sarama.NewMockWrapper(&sarama.TxnOffsetCommitResponse{}),
+		"ProduceRequest":            sarama.NewMockProduceResponse(t).SetVersion(3),
+		"EndTxnRequest":             sarama.NewMockWrapper(&sarama.EndTxnResponse{}),
+	}
+}
+
+func TestTransactionalProducer(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(txnHandlers(t, broker))
+
+	tp, err := NewTransactionalProducer("test-txn", "2.1.0.0", []string{broker.Addr()}, WithCompression(sarama.CompressionGZIP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	if err = tp.Send(&sarama.ProducerMessage{Topic: "test"}); err != ErrTxnNotBegun {
+		t.Errorf("send outside transaction err %v", err)
+	}
+	if err = tp.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = tp.Send(&sarama.ProducerMessage{Topic: "test", Key: sarama.StringEncoder("key"), Value: sarama.StringEncoder("test_data")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offsets := map[string][]*sarama.PartitionOffsetMetadata{"source": {{Partition: 0, Offset: 10}}}
+	if err = tp.SendOffsetsToTransaction(offsets, "test-group"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tp.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var produced, committed bool
+	for _, rr := range broker.History() {
+		switch req := rr.Request.(type) {
+		case *sarama.ProduceRequest:
+			produced = req.TransactionalID != nil && *req.TransactionalID == "test-txn"
+		case *sarama.EndTxnRequest:
+			committed = req.TransactionResult && req.ProducerID == 7 && req.ProducerEpoch == 1
+		}
+	}
+	if !produced || !committed {
+		t.Errorf("produced %v committed %v", produced, committed)
+	}
+	if tp.sequences[topicPartition{topic: "test", partition: 0}] != 3 {
+		t.Errorf("sequence %v", tp.sequences)
+	}
+}
+
+func TestTransactionalProducerAbort(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(txnHandlers(t, broker))
+
+	tp, err := NewTransactionalProducer("test-txn", "2.1.0.0", []string{broker.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	if err = tp.Abort(); err != ErrTxnNotBegun {
+		t.Errorf("abort outside transaction err %v", err)
+	}
+	if err = tp.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tp.Send(&sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("test_data")}); err != nil {
+		t.Fatal(err)
+	}
+	offsets := map[string][]*sarama.PartitionOffsetMetadata{"source": {{Partition: 0, Offset: 10}}}
+	if err = tp.SendOffsetsToTransaction(offsets, "test-group"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tp.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tp.Send(&sarama.ProducerMessage{Topic: "test"}); err != ErrTxnNotBegun {
+		t.Errorf("send after abort err %v", err)
+	}
+
+	var produced, aborted bool
+	for _, rr := range broker.History() {
+		switch req := rr.Request.(type) {
+		case *sarama.ProduceRequest:
+			produced = true
+		case *sarama.EndTxnRequest:
+			aborted = !req.TransactionResult
+		}
+	}
+	if produced || !aborted {
+		t.Errorf("produced %v aborted %v", produced, aborted)
+	}
+}
+
+func TestTransactionalProducerProduceError(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	handlers := txnHandlers(t, broker)
+	handlers["InitProducerIDRequest"] = sarama.NewMockSequence(
+		&sarama.InitProducerIDResponse{ProducerID: 7, ProducerEpoch: 1},
+		&sarama.InitProducerIDResponse{ProducerID: 7, ProducerEpoch: 2},
+	)
+	handlers["ProduceRequest"] = sarama.NewMockSequence(
+		sarama.NewMockProduceResponse(t).SetVersion(3).SetError("test", 0, sarama.ErrRequestTimedOut),
+		sarama.NewMockProduceResponse(t).SetVersion(3),
+	)
+	broker.SetHandlerByMap(handlers)
+
+	tp, err := NewTransactionalProducer("test-txn", "2.1.0.0", []string{broker.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	send := func() error {
+		if err := tp.Begin(); err != nil {
+			return err
+		}
+		for i := 0; i < 3; i++ {
+			if err := tp.Send(&sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("test_data")}); err != nil {
+				return err
+			}
+		}
+		return tp.Commit()
+	}
+	if err = send(); !errors.Is(err, sarama.ErrRequestTimedOut) {
+		t.Fatalf("commit err %v", err)
+	}
+	// the failed transaction is aborted and the sequences start over with
+	// a new epoch
+	if tp.producerEpoch != 2 || len(tp.sequences) != 0 {
+		t.Errorf("epoch %d sequences %v", tp.producerEpoch, tp.sequences)
+	}
+	if err = send(); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []bool
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.EndTxnRequest); ok {
+			results = append(results, req.TransactionResult)
+		}
+	}
+	if len(results) != 2 || results[0] || !results[1] {
+		t.Errorf("end transaction results %v", results)
+	}
+	if tp.sequences[topicPartition{topic: "test", partition: 0}] != 3 {
+		t.Errorf("sequence %v", tp.sequences)
+	}
+}
+
+func TestTransactionalProducerCoordinatorMoved(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	moved := sarama.NewMockBroker(t, 2)
+	defer moved.Close()
+	metadata := sarama.NewMockMetadataResponse(t).
+		SetBroker(broker.Addr(), broker.BrokerID()).
+		SetBroker(moved.Addr(), moved.BrokerID()).
+		SetLeader("test", 0, broker.BrokerID())
+	// the coordinator is looked up on either broker, both answer broker first
+	// and moved after
+	lookups := func() sarama.MockResponse {
+		return sarama.NewMockSequence(
+			&sarama.FindCoordinatorResponse{Version: 1, Coordinator: sarama.NewBroker(broker.Addr())},
+			&sarama.FindCoordinatorResponse{Version: 1, Coordinator: sarama.NewBroker(moved.Addr())},
+		)
+	}
+	handlers := txnHandlers(t, broker)
+	handlers["MetadataRequest"] = metadata
+	handlers["FindCoordinatorRequest"] = lookups()
+	handlers["EndTxnRequest"] = sarama.NewMockWrapper(&sarama.EndTxnResponse{Err: sarama.ErrNotCoordinatorForConsumer})
+	broker.SetHandlerByMap(handlers)
+	moved.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest":        metadata,
+		"FindCoordinatorRequest": lookups(),
+		"EndTxnRequest":          sarama.NewMockWrapper(&sarama.EndTxnResponse{}),
+	})
+
+	tp, err := NewTransactionalProducer("test-txn", "2.1.0.0", []string{broker.Addr()}, WithProducerRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	if err = tp.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tp.Send(&sarama.ProducerMessage{Topic: "test", Value: sarama.StringEncoder("test_data")}); err != nil {
+		t.Fatal(err)
+	}
+	if err = tp.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	committed := false
+	for _, rr := range moved.History() {
+		if req, ok := rr.Request.(*sarama.EndTxnRequest); ok {
+			committed = req.TransactionResult
+		}
+	}
+	if !committed {
+		t.Error("transaction not committed on the new coordinator")
+	}
+}
@@ -0,0 +1,80 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Shopify/sarama"
+	"github.com/jinglov/gomisc/monitor"
+)
+
+// TypedProducer sends values encoded with a Codec
+type TypedProducer struct {
+	producer *Producer
+	codec    Codec
+}
+
+func NewTypedProducer(producer *Producer, codec Codec) *TypedProducer {
+	return &TypedProducer{producer: producer, codec: codec}
+}
+
+// Send encodes v and sends it, the error is the encoding or the overflow one
+func (tp *TypedProducer) Send(topic string, v interface{}) error {
+	return tp.SendUseKey(topic, v, nil)
+}
+
+func (tp *TypedProducer) SendUseKey(topic string, v interface{}, key sarama.Encoder) error {
+	data, err := tp.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := tp.producer.sendContext()
+	defer cancel()
+	return tp.producer.SendMessageContext(ctx, &sarama.ProducerMessage{Topic: topic, Key: key, Value: sarama.ByteEncoder(data)})
+}
+
+// SendSync sends v and waits for the delivery, see Producer.SendSync
+func (tp *TypedProducer) SendSync(ctx context.Context, topic string, v interface{}, key sarama.Encoder) (int32, int64, error) {
+	data, err := tp.codec.Encode(v)
+	if err != nil {
+		return -1, -1, err
+	}
+	return tp.producer.SendSync(ctx, &sarama.ProducerMessage{Topic: topic, Key: key, Value: sarama.ByteEncoder(data)})
+}
+
+// NewTypedProcess returns a consumer process function that decodes the
+// message value into a new value of newValue and passes it to process.
+// Decode failures are counted with the decodeerror status and passed to the
+// WithDecodeErrorHandler handler, without one they fail the message as permanent.
+// A schema registry unreachable or answering 5xx fails it as retryable instead
+func NewTypedProcess(codec Codec, newValue func() interface{}, process func(msg *sarama.ConsumerMessage, v interface{}) error,
+	opts ...optFun) func(*sarama.ConsumerMessage) error {
+	options := &Options{}
+	for _, o := range opts {
+		o(options)
+	}
+	return func(msg *sarama.ConsumerMessage) error {
+		v := newValue()
+		if err := codec.Decode(msg.Value, v); err != nil {
+			var te *transientError
+			if errors.As(err, &te) {
+				// the schema registry is unavailable, the message is retried
+				return te.err
+			}
+			if options.vec != nil {
+				options.vec.Inc(&monitor.KafkaLabels{Partition: msg.Partition, Topic: msg.Topic, Status: "decodeerror"})
+			}
+			if options.decodeError != nil {
+				return options.decodeError(msg, err)
+			}
+			return Permanent(err)
+		}
+		return process(msg, v)
+	}
+}
+
+// NewTypedConsumer is NewConsumerV2 with a NewTypedProcess process function
+func NewTypedConsumer(groupName string, version string, topics []string, brokers []string, codec Codec, newValue func() interface{},
+	process func(msg *sarama.ConsumerMessage, v interface{}) error, opts ...optFun) (Consumer, error) {
+	return NewConsumerV2(groupName, version, topics, brokers, NewTypedProcess(codec, newValue, process, opts...), opts...)
+}
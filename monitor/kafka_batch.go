@@ -0,0 +1,41 @@
+package monitor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	kafkaBatchLabels         = []string{"topic"}
+	kafkaBatchSizeBuckets    = []float64{1, 10, 50, 100, 500, 1000, 5000}
+	kafkaBatchLatencyBuckets = []float64{1.0, 5.0, 10.0, 50.0, 100.0, 500.0, 1000.0}
+)
+
+type KafkaBatchVec struct {
+	sizeVec    *prometheus.HistogramVec
+	latencyVec *prometheus.HistogramVec
+}
+
+type KafkaBatchLabels struct {
+	Topic string
+}
+
+func (l *KafkaBatchLabels) toPrometheusLable() prometheus.Labels {
+	return prometheus.Labels{
+		"topic": l.Topic,
+	}
+}
+
+func NewKafkaBatchVec(namespace, subsystem, name string) *KafkaBatchVec {
+	return &KafkaBatchVec{
+		sizeVec:    NewHistogramVec(namespace, subsystem, name+"_size", "ac kafka batch size by handlers", kafkaBatchLabels, kafkaBatchSizeBuckets),
+		latencyVec: NewHistogramVec(namespace, subsystem, name+"_flush_time", "ac kafka batch flush latency by handlers", kafkaBatchLabels, kafkaBatchLatencyBuckets),
+	}
+}
+
+func (kv *KafkaBatchVec) ObserveSize(labels *KafkaBatchLabels, size float64) {
+	kv.sizeVec.With(labels.toPrometheusLable()).Observe(size)
+}
+
+func (kv *KafkaBatchVec) ObserveLatency(labels *KafkaBatchLabels, elapsed float64) {
+	kv.latencyVec.With(labels.toPrometheusLable()).Observe(elapsed)
+}
@@ -0,0 +1,48 @@
+package monitor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	kafkaClusterLabels       = []string{"cluster", "topic", "status"}
+	kafkaClusterActiveLabels = []string{"cluster"}
+)
+
+type KafkaClusterVec struct {
+	vec       *prometheus.CounterVec
+	activeVec *prometheus.GaugeVec
+}
+
+// KafkaClusterLabels of a producer message sent to a cluster, failover and
+// failback are reported with an empty topic
+type KafkaClusterLabels struct {
+	Cluster, Topic, Status string
+}
+
+func (l *KafkaClusterLabels) toPrometheusLable() prometheus.Labels {
+	return prometheus.Labels{
+		"cluster": l.Cluster,
+		"topic":   l.Topic,
+		"status":  l.Status,
+	}
+}
+
+func NewKafkaClusterVec(namespace, subsystem, name string) *KafkaClusterVec {
+	return &KafkaClusterVec{
+		vec:       NewCounterVec(namespace, subsystem, name, "ac kafka producer counter by cluster", kafkaClusterLabels),
+		activeVec: NewGaugeVec(namespace, subsystem, name+"_active", "ac kafka producer active cluster, 1 when active", kafkaClusterActiveLabels),
+	}
+}
+
+func (kv *KafkaClusterVec) Inc(labels *KafkaClusterLabels) {
+	kv.vec.With(labels.toPrometheusLable()).Inc()
+}
+
+func (kv *KafkaClusterVec) SetActive(cluster string, active bool) {
+	v := 0.0
+	if active {
+		v = 1
+	}
+	kv.activeVec.With(prometheus.Labels{"cluster": cluster}).Set(v)
+}
@@ -0,0 +1,59 @@
+package monitor
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	kafkaLagLabels      = []string{"group", "topic", "partition"}
+	kafkaTopicLagLabels = []string{"group", "topic"}
+)
+
+type KafkaLagVec struct {
+	lagVec      *prometheus.GaugeVec
+	topicLagVec *prometheus.GaugeVec
+	idleVec     *prometheus.GaugeVec
+}
+
+type KafkaLagLabels struct {
+	Group, Topic string
+	Partition    int32
+}
+
+func (l *KafkaLagLabels) toPrometheusLable() prometheus.Labels {
+	return prometheus.Labels{
+		"group":     l.Group,
+		"topic":     l.Topic,
+		"partition": strconv.Itoa(int(l.Partition)),
+	}
+}
+
+func (l *KafkaLagLabels) toTopicPrometheusLable() prometheus.Labels {
+	return prometheus.Labels{
+		"group": l.Group,
+		"topic": l.Topic,
+	}
+}
+
+func NewKafkaLagVec(namespace, subsystem, name string) *KafkaLagVec {
+	return &KafkaLagVec{
+		lagVec:      NewGaugeVec(namespace, subsystem, name, "ac kafka consumer group lag by partition", kafkaLagLabels),
+		topicLagVec: NewGaugeVec(namespace, subsystem, name+"_topic", "ac kafka consumer group lag by topic", kafkaTopicLagLabels),
+		idleVec:     NewGaugeVec(namespace, subsystem, name+"_idle_seconds", "ac kafka seconds the group has been lagging without committing", kafkaLagLabels),
+	}
+}
+
+func (kv *KafkaLagVec) SetLag(labels *KafkaLagLabels, lag float64) {
+	kv.lagVec.With(labels.toPrometheusLable()).Set(lag)
+}
+
+// SetTopicLag sets the lag summed over the partitions of labels.Topic
+func (kv *KafkaLagVec) SetTopicLag(labels *KafkaLagLabels, lag float64) {
+	kv.topicLagVec.With(labels.toTopicPrometheusLable()).Set(lag)
+}
+
+func (kv *KafkaLagVec) SetIdle(labels *KafkaLagLabels, seconds float64) {
+	kv.idleVec.With(labels.toPrometheusLable()).Set(seconds)
+}
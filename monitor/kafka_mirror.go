@@ -0,0 +1,55 @@
+package monitor
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	kafkaMirrorLabels    = []string{"mirror", "topic", "status"}
+	kafkaMirrorLagLabels = []string{"mirror", "topic", "partition"}
+)
+
+type KafkaMirrorVec struct {
+	vec    *prometheus.CounterVec
+	lagVec *prometheus.GaugeVec
+}
+
+// KafkaMirrorLabels of a source message, Status is only used by the counter
+// and Partition by the lag
+type KafkaMirrorLabels struct {
+	Mirror, Topic, Status string
+	Partition             int32
+}
+
+func (l *KafkaMirrorLabels) toPrometheusLable() prometheus.Labels {
+	return prometheus.Labels{
+		"mirror": l.Mirror,
+		"topic":  l.Topic,
+		"status": l.Status,
+	}
+}
+
+func (l *KafkaMirrorLabels) toLagPrometheusLable() prometheus.Labels {
+	return prometheus.Labels{
+		"mirror":    l.Mirror,
+		"topic":     l.Topic,
+		"partition": strconv.Itoa(int(l.Partition)),
+	}
+}
+
+func NewKafkaMirrorVec(namespace, subsystem, name string) *KafkaMirrorVec {
+	return &KafkaMirrorVec{
+		vec:    NewCounterVec(namespace, subsystem, name, "ac kafka mirrored messages by source topic", kafkaMirrorLabels),
+		lagVec: NewGaugeVec(namespace, subsystem, name+"_lag", "ac kafka mirror messages of the source partition not acknowledged by the destination", kafkaMirrorLagLabels),
+	}
+}
+
+func (kv *KafkaMirrorVec) Inc(labels *KafkaMirrorLabels) {
+	kv.vec.With(labels.toPrometheusLable()).Inc()
+}
+
+func (kv *KafkaMirrorVec) SetLag(labels *KafkaMirrorLabels, lag float64) {
+	kv.lagVec.With(labels.toLagPrometheusLable()).Set(lag)
+}
@@ -0,0 +1,42 @@
+package monitor
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var kafkaPausedLabels = []string{"group", "topic", "partition"}
+
+type KafkaPausedVec struct {
+	vec *prometheus.GaugeVec
+}
+
+// KafkaPausedLabels of a paused partition, PauseAll is reported with an
+// empty topic and partition -1
+type KafkaPausedLabels struct {
+	Group, Topic string
+	Partition    int32
+}
+
+func (l *KafkaPausedLabels) toPrometheusLable() prometheus.Labels {
+	return prometheus.Labels{
+		"group":     l.Group,
+		"topic":     l.Topic,
+		"partition": strconv.Itoa(int(l.Partition)),
+	}
+}
+
+func NewKafkaPausedVec(namespace, subsystem, name string) *KafkaPausedVec {
+	return &KafkaPausedVec{
+		vec: NewGaugeVec(namespace, subsystem, name, "ac kafka consumer paused state, 1 when paused", kafkaPausedLabels),
+	}
+}
+
+func (kv *KafkaPausedVec) SetPaused(labels *KafkaPausedLabels, paused bool) {
+	v := 0.0
+	if paused {
+		v = 1
+	}
+	kv.vec.With(labels.toPrometheusLable()).Set(v)
+}